@@ -12,6 +12,7 @@ import (
 
 	"substack-auth/auth-improved/internal/handler"
 	"substack-auth/auth-improved/internal/service"
+	"substack-auth/pkg/codec"
 	"substack-auth/pkg/config"
 	"substack-auth/pkg/database"
 	"substack-auth/pkg/jwt"
@@ -49,9 +50,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	userService := service.NewUserService(db, redisClient, cfg)
+	userCodec, err := codec.New(cfg)
+	if err != nil {
+		logger.Error("Failed to initialize cache codec", "error", err)
+		os.Exit(1)
+	}
+
+	if size, err := codec.SampleSize(userCodec); err == nil {
+		redisClient.CheckListpack(context.Background(), size)
+	}
+
+	userService := service.NewUserService(db, redisClient, userCodec, cfg)
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go userService.WatchInvalidations(watchCtx)
 	authService := service.NewAuthService(userService, jwtService)
 	authHandler := handler.NewAuthHandler(authService)
+	userHandler := handler.NewUserHandler(authService)
+	statsHandler := handler.NewStatsHandler(userService)
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -59,6 +76,13 @@ func main() {
 	r.Use(middleware.RequestID)
 
 	r.Post("/login", authHandler.Login)
+	r.Post("/users", userHandler.Create)
+	r.Group(func(r chi.Router) {
+		r.Use(handler.RequireAuth(jwtService))
+		r.Put("/users/me/password", userHandler.ChangePassword)
+		r.Delete("/users/me", userHandler.Delete)
+	})
+	r.Get("/stats", statsHandler.Stats)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Service.AuthImprovedPort),
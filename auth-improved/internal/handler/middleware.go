@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const usernameKey contextKey = "username"
+
+type TokenValidator interface {
+	ValidateToken(token string) (string, error)
+}
+
+// RequireAuth rejects requests without a valid bearer token and stores the
+// token's subject for handlers to read with usernameFromContext.
+func RequireAuth(validator TokenValidator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			username, err := validator.ValidateToken(token)
+			if err != nil {
+				slog.Error("Invalid token", "error", err)
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), usernameKey, username)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func usernameFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(usernameKey).(string)
+	return username
+}
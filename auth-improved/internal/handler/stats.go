@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"substack-auth/pkg/models"
+)
+
+type StatsHandler struct {
+	userService UserService
+}
+
+type UserService interface {
+	Stats() models.CacheStats
+}
+
+func NewStatsHandler(userService UserService) *StatsHandler {
+	return &StatsHandler{userService: userService}
+}
+
+func (h *StatsHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(h.userService.Stats()); err != nil {
+		slog.Error("Failed to encode stats", "error", err)
+	}
+}
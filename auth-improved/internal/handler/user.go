@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"substack-auth/auth-improved/internal/service"
+	"substack-auth/pkg/models"
+)
+
+type UserHandler struct {
+	accountService AccountService
+}
+
+type AccountService interface {
+	Register(req *models.CreateUserRequest) (*models.UserResponse, error)
+	ChangePassword(username string, req *models.ChangePasswordRequest) error
+	DeleteAccount(username string) error
+}
+
+func NewUserHandler(accountService AccountService) *UserHandler {
+	return &UserHandler{accountService: accountService}
+}
+
+func (h *UserHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request", "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		http.Error(w, "Username and password are required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.accountService.Register(&req)
+	if err != nil {
+		slog.Error("Create user failed", "username", req.Username, "error", err)
+		writeAccountError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromContext(r.Context())
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request", "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, "Current and new password are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.accountService.ChangePassword(username, &req); err != nil {
+		slog.Error("Change password failed", "username", username, "error", err)
+		writeAccountError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromContext(r.Context())
+
+	if err := h.accountService.DeleteAccount(username); err != nil {
+		slog.Error("Delete user failed", "username", username, "error", err)
+		writeAccountError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAccountError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrUserExists):
+		http.Error(w, "User already exists", http.StatusConflict)
+	case errors.Is(err, service.ErrUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrInvalidCredentials):
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	case errors.Is(err, service.ErrCacheUnavailable):
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
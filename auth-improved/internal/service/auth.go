@@ -1,6 +1,7 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 
@@ -10,6 +11,8 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
 type AuthService struct {
 	userService *UserService
 	jwtService  *jwt.JWT
@@ -23,15 +26,9 @@ func NewAuthService(userService *UserService, jwtService *jwt.JWT) *AuthService
 }
 
 func (s *AuthService) Login(req *models.LoginRequest) (*models.LoginResponse, error) {
-	user, err := s.userService.GetByUsername(req.Username)
+	user, err := s.verifyCredentials(req.Username, req.Password)
 	if err != nil {
-		slog.Error("User not found", "username", req.Username)
-		return nil, fmt.Errorf("invalid credentials")
-	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		slog.Error("Invalid password", "username", req.Username)
-		return nil, fmt.Errorf("invalid credentials")
+		return nil, err
 	}
 
 	token, err := s.jwtService.GenerateToken(user.Username)
@@ -40,6 +37,8 @@ func (s *AuthService) Login(req *models.LoginRequest) (*models.LoginResponse, er
 		return nil, fmt.Errorf("failed to generate token")
 	}
 
+	s.userService.RecordLogin(user)
+
 	slog.Info("User logged in successfully", "username", req.Username)
 
 	return &models.LoginResponse{
@@ -51,3 +50,53 @@ func (s *AuthService) Login(req *models.LoginRequest) (*models.LoginResponse, er
 		},
 	}, nil
 }
+
+func (s *AuthService) Register(req *models.CreateUserRequest) (*models.UserResponse, error) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user, err := s.userService.Create(req.Username, string(passwordHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.UserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		CreatedAt: user.CreatedAt,
+	}, nil
+}
+
+func (s *AuthService) ChangePassword(username string, req *models.ChangePasswordRequest) error {
+	if _, err := s.verifyCredentials(username, req.CurrentPassword); err != nil {
+		return err
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return s.userService.UpdatePassword(username, string(passwordHash))
+}
+
+func (s *AuthService) DeleteAccount(username string) error {
+	return s.userService.Delete(username)
+}
+
+func (s *AuthService) verifyCredentials(username, password string) (*models.User, error) {
+	user, err := s.userService.GetByUsername(username)
+	if err != nil {
+		slog.Error("User not found", "username", username)
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		slog.Error("Invalid password", "username", username)
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
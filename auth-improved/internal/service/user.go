@@ -3,64 +3,460 @@ package service
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"substack-auth/pkg/breaker"
+	"substack-auth/pkg/codec"
 	"substack-auth/pkg/config"
 	"substack-auth/pkg/database"
+	"substack-auth/pkg/lru"
 	"substack-auth/pkg/models"
 	"substack-auth/pkg/redis"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/sync/singleflight"
 )
 
 type UserService struct {
-	db    *database.Database
-	redis *redis.Redis
-	cfg   *config.Config
+	db      *database.Database
+	redis   *redis.Redis
+	codec   codec.Codec
+	cfg     *config.Config
+	local   *lru.Cache[models.User] // keyed by KeyFor(username), as invalidations are
+	breaker *breaker.Breaker
+	fills   singleflight.Group
+	stats   userStats
+}
+
+type userStats struct {
+	cacheMisses         atomic.Int64
+	databaseLoads       atomic.Int64
+	fillLockAcquired    atomic.Int64
+	fillLockContended   atomic.Int64
+	fillLockServedCache atomic.Int64
+	fillLockNotFound    atomic.Int64
+	staleServed         atomic.Int64
+	refreshes           atomic.Int64
+	cacheWriteFailures  atomic.Int64
+	integrityFailures   atomic.Int64
+	refreshesQueued     atomic.Int64
+	refreshQueueFull    atomic.Int64
 }
 
-func NewUserService(db *database.Database, redis *redis.Redis, cfg *config.Config) *UserService {
-	return &UserService{
+var (
+	ErrUserExists       = errors.New("user already exists")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrCacheUnavailable = errors.New("cache unavailable, refusing write")
+)
+
+const mysqlDuplicateEntry = 1062
+
+// activityTimeout bounds the background write of a login to the activity
+// set, so a slow Redis cannot pile up goroutines behind logins.
+const activityTimeout = 200 * time.Millisecond
+
+// staleReloadDelay is how long after a write the cache entry is deleted a
+// second time, to catch a concurrent login that reloaded the old row between
+// the first delete and the database commit.
+const staleReloadDelay = time.Second
+
+func NewUserService(db *database.Database, redis *redis.Redis, codec codec.Codec, cfg *config.Config) *UserService {
+	s := &UserService{
 		db:    db,
 		redis: redis,
+		codec: codec,
 		cfg:   cfg,
 	}
+
+	if cfg.Features.CacheEnabled && cfg.Features.L1CacheEnabled {
+		s.local = lru.New[models.User](cfg.L1Cache.Size, cfg.L1Cache.TTL)
+		slog.Info("L1 cache enabled", "size", cfg.L1Cache.Size, "ttl", cfg.L1Cache.TTL)
+	}
+
+	if cfg.Features.CacheEnabled && cfg.Features.CircuitBreakerEnabled {
+		s.breaker = breaker.New("redis", cfg.CircuitBreaker.FailureThreshold, cfg.CircuitBreaker.SlowCallThreshold, cfg.CircuitBreaker.OpenTimeout)
+		slog.Info("Redis circuit breaker enabled",
+			"failure_threshold", cfg.CircuitBreaker.FailureThreshold,
+			"slow_call_threshold", cfg.CircuitBreaker.SlowCallThreshold,
+			"open_timeout", cfg.CircuitBreaker.OpenTimeout)
+	}
+
+	return s
+}
+
+// WatchInvalidations keeps the L1 cache in sync with invalidations broadcast
+// by other replicas. It blocks until ctx is done and returns immediately when
+// the L1 cache is disabled.
+func (s *UserService) WatchInvalidations(ctx context.Context) {
+	if s.local == nil {
+		return
+	}
+
+	s.redis.SubscribeInvalidations(ctx,
+		func(name string) {
+			s.local.Delete(name)
+		},
+		func() {
+			slog.Info("Invalidation subscription established, purging L1 cache", "entries", s.local.Len())
+			s.local.Purge()
+		},
+	)
+}
+
+// RecordLogin notes a successful login in the activity set that the
+// precache worker's hot-set mode ranks users by. The write happens in the
+// background: activity only steers precaching, so it must neither fail nor
+// slow down the login. It bypasses the circuit breaker, whose state should
+// reflect the calls logins wait on, not a fire-and-forget write with its
+// own short timeout.
+func (s *UserService) RecordLogin(user *models.User) {
+	if !s.cfg.Features.ActivityTrackingEnabled {
+		return
+	}
+
+	at := time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), activityTimeout)
+		defer cancel()
+
+		if err := s.redis.RecordLogin(ctx, user.ID, at); err != nil {
+			slog.Warn("Failed to record login activity", "user_id", user.ID, "error", err)
+		}
+	}()
+}
+
+// Invalidate drops username from the L1 cache of every replica.
+func (s *UserService) Invalidate(username string) error {
+	if s.local == nil {
+		return nil
+	}
+
+	s.local.Delete(s.redis.KeyFor(username))
+	return s.guard(func() error {
+		return s.redis.PublishInvalidation(context.Background(), username)
+	})
 }
 
 func (s *UserService) GetByUsername(username string) (*models.User, error) {
 	if s.cfg.Features.CacheEnabled {
-		if user, err := s.getFromCache(username); err == nil {
-			return user, nil
+		if s.local != nil {
+			if user, ok := s.local.Get(s.redis.KeyFor(username)); ok {
+				return &user, nil
+			}
+		}
+
+		if entry, err := s.getFromCache(username); err == nil {
+			if entry.Stale(time.Now()) {
+				s.stats.staleServed.Add(1)
+				s.refreshInBackground(username)
+			}
+			s.cacheLocally(username, entry.User)
+			return entry.User, nil
 		}
 	}
 
 	slog.Debug("Cache miss: ", "username", username)
 
+	if s.cfg.Features.BloomFilterEnabled && s.definitelyUnknown(username) {
+		slog.Debug("Rejected by bloom filter", "username", username)
+		return nil, ErrUserNotFound
+	}
+
+	// Concurrent misses for the same username share a single load.
+	s.stats.cacheMisses.Add(1)
+	v, err, _ := s.fills.Do(username, func() (interface{}, error) {
+		return s.load(username)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user := *v.(*models.User)
+	return &user, nil
+}
+
+// Stats returns the lookup counters. Coalesced is the number of cache misses
+// and background refreshes that were answered by another in-flight load.
+func (s *UserService) Stats() models.CacheStats {
+	misses := s.stats.cacheMisses.Load()
+	refreshes := s.stats.refreshes.Load()
+	loads := s.stats.databaseLoads.Load()
+	served := s.stats.fillLockServedCache.Load()
+
+	stats := models.CacheStats{
+		CacheMisses:         misses,
+		DatabaseLoads:       loads,
+		Coalesced:           misses + refreshes - loads - served,
+		FillLockAcquired:    s.stats.fillLockAcquired.Load(),
+		FillLockContended:   s.stats.fillLockContended.Load(),
+		FillLockServedCache: served,
+		FillLockNotFound:    s.stats.fillLockNotFound.Load(),
+		StaleServed:         s.stats.staleServed.Load(),
+		BackgroundRefreshes: refreshes,
+		CacheWriteFailures:  s.stats.cacheWriteFailures.Load(),
+		IntegrityFailures:   s.stats.integrityFailures.Load(),
+		RefreshesQueued:     s.stats.refreshesQueued.Load(),
+		RefreshQueueFull:    s.stats.refreshQueueFull.Load(),
+	}
+
+	if s.breaker != nil {
+		stats.BreakerState = s.breaker.State().String()
+		stats.BreakerOpened = s.breaker.Opened()
+		stats.BreakerRejected = s.breaker.Rejected()
+	}
+
+	return stats
+}
+
+// guard runs a Redis call through the circuit breaker. Misses, a missing
+// Bloom filter and a full refresh queue are healthy answers and do not count
+// against Redis. While the breaker is open the call is skipped and
+// breaker.ErrOpen returned, which every caller treats like a cache failure
+// and falls back to the database.
+func (s *UserService) guard(fn func() error) error {
+	if s.breaker == nil {
+		return fn()
+	}
+
+	var result error
+	err := s.breaker.Do(func() error {
+		result = fn()
+		if errors.Is(result, redis.Nil) || errors.Is(result, redis.ErrBloomUnavailable) || errors.Is(result, redis.ErrRefreshQueueFull) {
+			return nil
+		}
+		return result
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		return err
+	}
+	return result
+}
+
+// load fetches username from the database and repopulates the caches. With
+// the fill lock enabled only one replica does this at a time; the others
+// wait for its result to appear in Redis and only fall back to the database
+// if it does not show up before the lock expires. A holder that finds no
+// such user leaves a short-lived marker so waiters give up at once.
+func (s *UserService) load(username string) (*models.User, error) {
+	var lockName string
+	var holding bool
+
+	if s.cfg.Features.CacheEnabled && s.cfg.Features.FillLockEnabled {
+		ctx := context.Background()
+		lockName = "fill:" + s.redis.KeyFor(username)
+
+		var token string
+		var acquired bool
+		err := s.guard(func() error {
+			var err error
+			token, acquired, err = s.redis.AcquireLock(ctx, lockName, s.cfg.FillLock.TTL)
+			return err
+		})
+		switch {
+		case err != nil:
+			if !errors.Is(err, breaker.ErrOpen) {
+				slog.Error("Failed to acquire fill lock", "username", username, "error", err)
+			}
+		case acquired:
+			s.stats.fillLockAcquired.Add(1)
+			holding = true
+			defer func() {
+				err := s.guard(func() error {
+					return s.redis.ReleaseLock(ctx, lockName, token)
+				})
+				if err != nil {
+					slog.Error("Failed to release fill lock", "username", username, "error", err)
+				}
+			}()
+		default:
+			s.stats.fillLockContended.Add(1)
+			user, err := s.waitForFill(username, lockName)
+			if errors.Is(err, ErrUserNotFound) {
+				s.stats.fillLockNotFound.Add(1)
+				return nil, err
+			}
+			if user != nil {
+				s.stats.fillLockServedCache.Add(1)
+				s.cacheLocally(username, user)
+				return user, nil
+			}
+		}
+	}
+
+	s.stats.databaseLoads.Add(1)
 	user, err := s.getFromDatabase(username)
 	if err != nil {
+		if holding && errors.Is(err, ErrUserNotFound) {
+			s.markMissing(lockName)
+		}
 		return nil, err
 	}
 
 	if s.cfg.Features.CacheEnabled {
-		s.cacheUser(username, user)
+		if holding {
+			// Replicas waiting on the lock poll Redis for the entry; queuing
+			// it would keep them waiting until the lock expires.
+			s.cacheUser(username, user)
+		} else {
+			s.fill(username, user)
+		}
+		s.cacheLocally(username, user)
 	}
 
 	return user, nil
 }
 
-func (s *UserService) getFromCache(username string) (*models.User, error) {
+// fill puts a user loaded on a miss into Redis when no other replica waits
+// for it. With the refresh queue enabled the write is handed to the precache
+// worker so the request does not wait for it; when the queue is full the
+// entry is simply not cached, and the next miss tries again.
+func (s *UserService) fill(username string, user *models.User) {
+	if !s.cfg.Features.RefreshQueueEnabled {
+		s.cacheUser(username, user)
+		return
+	}
+
+	var queued bool
+	err := s.guard(func() error {
+		var err error
+		queued, err = s.redis.EnqueueRefresh(context.Background(), user.ID, s.cfg.RefreshQueue.MaxLength)
+		return err
+	})
+	switch {
+	case errors.Is(err, redis.ErrRefreshQueueFull):
+		s.stats.refreshQueueFull.Add(1)
+		slog.Warn("Refresh queue full, not caching user", "username", username)
+	case err != nil:
+		if !errors.Is(err, breaker.ErrOpen) {
+			slog.Error("Failed to queue cache refresh", "username", username, "error", err)
+		}
+	case queued:
+		s.stats.refreshesQueued.Add(1)
+	}
+}
+
+// refreshInBackground reloads a stale entry without blocking the caller. It
+// shares the in-flight load for the username, so a burst of requests for the
+// same stale entry triggers a single refresh.
+func (s *UserService) refreshInBackground(username string) {
+	s.stats.refreshes.Add(1)
+	go func() {
+		_, err, _ := s.fills.Do(username, func() (interface{}, error) {
+			return s.load(username)
+		})
+		if err != nil {
+			slog.Error("Background refresh failed", "username", username, "error", err)
+		}
+	}()
+}
+
+// waitForFill polls Redis until the fill lock holder has cached username.
+// It returns ErrUserNotFound as soon as the holder marks the user missing,
+// and a nil user when the lock expires or Redis becomes unusable.
+func (s *UserService) waitForFill(username, lockName string) (*models.User, error) {
+	deadline := time.Now().Add(s.cfg.FillLock.TTL)
+	for time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		entry, err := s.getFromCache(username)
+		if err == nil {
+			return entry.User, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		var missing bool
+		err = s.guard(func() error {
+			var err error
+			missing, err = s.redis.Missing(context.Background(), lockName)
+			return err
+		})
+		if err != nil {
+			return nil, nil
+		}
+		if missing {
+			return nil, ErrUserNotFound
+		}
+	}
+	return nil, nil
+}
+
+// markMissing tells the replicas waiting on lockName that the user does not
+// exist. The marker lives as long as the lock would have.
+func (s *UserService) markMissing(lockName string) {
+	err := s.guard(func() error {
+		return s.redis.MarkMissing(context.Background(), lockName, s.cfg.FillLock.TTL)
+	})
+	if err != nil && !errors.Is(err, breaker.ErrOpen) {
+		slog.Error("Failed to mark user missing", "lock", lockName, "error", err)
+	}
+}
+
+func (s *UserService) getFromCache(username string) (*codec.Entry, error) {
 	ctx := context.Background()
-	data, err := s.redis.Get(ctx, username)
+	var data string
+	err := s.guard(func() error {
+		var err error
+		data, err = s.redis.Get(ctx, username)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var user models.User
-	if err := json.Unmarshal([]byte(data), &user); err != nil {
+	entry, err := s.codec.Decode([]byte(data))
+	if err == nil && !strings.EqualFold(entry.User.Username, username) {
+		err = fmt.Errorf("%w: entry belongs to %q", codec.ErrIntegrity, entry.User.Username)
+	}
+	switch {
+	case errors.Is(err, codec.ErrIntegrity):
+		s.stats.integrityFailures.Add(1)
+		slog.Warn("Security event: cache integrity check failed", "username", username, "error", err)
+		s.evictUntrusted(username)
+	case errors.Is(err, codec.ErrUnsigned):
+		s.evictUntrusted(username)
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	return entry, nil
+}
+
+// evictUntrusted removes a cache value that failed verification so the next
+// lookup reloads it from MySQL and caches a properly signed copy.
+func (s *UserService) evictUntrusted(username string) {
+	err := s.guard(func() error {
+		return s.redis.Delete(context.Background(), username)
+	})
+	if err != nil && !errors.Is(err, breaker.ErrOpen) {
+		slog.Error("Failed to evict untrusted cache entry", "username", username, "error", err)
+	}
+}
+
+// definitelyUnknown consults the username filter published by the precache
+// worker. Any error, including a missing filter, counts as "maybe known" so
+// the lookup falls through to the database.
+func (s *UserService) definitelyUnknown(username string) bool {
+	ctx := context.Background()
+	var mayContain bool
+	err := s.guard(func() error {
+		var err error
+		mayContain, err = s.redis.BloomMayContain(ctx, username)
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, redis.ErrBloomUnavailable) && !errors.Is(err, breaker.ErrOpen) {
+			slog.Error("Failed to check bloom filter", "username", username, "error", err)
+		}
+		return false
+	}
+	return !mayContain
 }
 
 func (s *UserService) getFromDatabase(username string) (*models.User, error) {
@@ -70,7 +466,7 @@ func (s *UserService) getFromDatabase(username string) (*models.User, error) {
 	err := s.db.DB.Get(&user, query, username)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -80,13 +476,187 @@ func (s *UserService) getFromDatabase(username string) (*models.User, error) {
 
 func (s *UserService) cacheUser(username string, user *models.User) {
 	ctx := context.Background()
-	data, err := json.Marshal(user)
+	data, err := s.codec.Encode(&codec.Entry{User: user, SoftExpiresAt: s.redis.SoftExpiry()})
 	if err != nil {
-		slog.Error("Failed to marshal user for cache", "username", username, "error", err)
+		slog.Error("Failed to encode user for cache", "username", username, "error", err)
 		return
 	}
 
-	if err := s.redis.Set(ctx, username, string(data)); err != nil {
+	err = s.guard(func() error {
+		return s.redis.Set(ctx, username, string(data))
+	})
+	if err != nil && !errors.Is(err, breaker.ErrOpen) {
 		slog.Error("Failed to cache user", "username", username, "error", err)
 	}
 }
+
+func (s *UserService) cacheLocally(username string, user *models.User) {
+	if s.local != nil {
+		s.local.Set(s.redis.KeyFor(username), *user)
+	}
+}
+
+// Writes keep MySQL as the source of truth and narrow, but do not close,
+// the window in which Redis can serve a row older than the database:
+//
+//  1. Before the database write, the cached entry is deleted. If that fails
+//     the write is refused with ErrCacheUnavailable and nothing changes.
+//  2. The database write runs.
+//  3. The entry is deleted again, dropping anything a login cached between
+//     steps 1 and 2. A failure here is logged and counted but not returned:
+//     step 1 already removed the old value, so the next login simply misses
+//     and reloads.
+//  4. After staleReloadDelay the entry is deleted once more, in case a login
+//     that read the old row between steps 1 and 2 cached it again.
+//
+// Cache writes are unconditional, so any writer that read the row before
+// step 2 and writes after step 4 puts the old value back: a login whose
+// fill took longer than staleReloadDelay, a precache sweep batch, the
+// refresh queue consumer or cache-checker -repair. The old password hash or
+// deleted user then stays valid until the next full sweep rewrites or
+// evicts it, or until REDIS_TTL expires.
+//
+// Create is the exception: a new user has no cached entry to go stale, so
+// it skips the deletes and writes the new row through to Redis instead.
+//
+// With the cache disabled only step 2 runs.
+
+// Create inserts a user and writes it through to the cache.
+func (s *UserService) Create(username, passwordHash string) (*models.User, error) {
+	query := `INSERT INTO users (username, password_hash) VALUES (?, ?)`
+
+	if _, err := s.db.DB.Exec(query, username, passwordHash); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			return nil, ErrUserExists
+		}
+		slog.Error("Failed to create user", "username", username, "error", err)
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	user, err := s.getFromDatabase(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cfg.Features.CacheEnabled {
+		// The filter must learn the username or it would be rejected until
+		// the next precache run.
+		if s.cfg.Features.BloomFilterEnabled {
+			if err := s.guard(func() error { return s.redis.BloomAdd(context.Background(), username) }); err != nil {
+				slog.Error("Failed to add user to bloom filter", "username", username, "error", err)
+			}
+		}
+		s.writeThrough(username, user)
+	}
+
+	slog.Info("User created", "username", username)
+	return user, nil
+}
+
+// UpdatePassword changes a user's password hash and deletes the cached entry
+// twice, so the next login loads the new hash.
+func (s *UserService) UpdatePassword(username, passwordHash string) error {
+	if err := s.evictBeforeWrite(username); err != nil {
+		return err
+	}
+
+	query := `UPDATE users SET password_hash = ? WHERE username = ?`
+	result, err := s.db.DB.Exec(query, passwordHash, username)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return ErrUserNotFound
+	}
+
+	if s.cfg.Features.CacheEnabled {
+		if err := s.evict(username); err != nil {
+			s.stats.cacheWriteFailures.Add(1)
+			slog.Error("Failed to evict user after password change", "username", username, "error", err)
+		}
+		s.evictLater(username)
+	}
+
+	slog.Info("User password updated", "username", username)
+	return nil
+}
+
+// Delete removes a user and its cache entry.
+func (s *UserService) Delete(username string) error {
+	if err := s.evictBeforeWrite(username); err != nil {
+		return err
+	}
+
+	query := `DELETE FROM users WHERE username = ?`
+	result, err := s.db.DB.Exec(query, username)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return ErrUserNotFound
+	}
+
+	if s.cfg.Features.CacheEnabled {
+		if err := s.evict(username); err != nil {
+			s.stats.cacheWriteFailures.Add(1)
+			slog.Error("Failed to evict deleted user", "username", username, "error", err)
+		}
+		s.evictLater(username)
+	}
+
+	slog.Info("User deleted", "username", username)
+	return nil
+}
+
+func (s *UserService) evictBeforeWrite(username string) error {
+	if !s.cfg.Features.CacheEnabled {
+		return nil
+	}
+
+	if err := s.evict(username); err != nil {
+		slog.Error("Failed to evict user before write", "username", username, "error", err)
+		return ErrCacheUnavailable
+	}
+	return nil
+}
+
+func (s *UserService) evict(username string) error {
+	s.fills.Forget(username)
+
+	err := s.guard(func() error {
+		return s.redis.Delete(context.Background(), username)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Invalidate(username)
+}
+
+func (s *UserService) evictLater(username string) {
+	time.AfterFunc(staleReloadDelay, func() {
+		if err := s.evict(username); err != nil {
+			s.stats.cacheWriteFailures.Add(1)
+			slog.Error("Failed to evict user after write", "username", username, "error", err)
+		}
+	})
+}
+
+func (s *UserService) writeThrough(username string, user *models.User) {
+	data, err := s.codec.Encode(&codec.Entry{User: user, SoftExpiresAt: s.redis.SoftExpiry()})
+	if err == nil {
+		err = s.guard(func() error {
+			return s.redis.Set(context.Background(), username, string(data))
+		})
+	}
+	if err != nil {
+		s.stats.cacheWriteFailures.Add(1)
+		slog.Error("Failed to write user through to cache", "username", username, "error", err)
+		return
+	}
+
+	if err := s.Invalidate(username); err != nil {
+		slog.Error("Failed to broadcast invalidation", "username", username, "error", err)
+	}
+}
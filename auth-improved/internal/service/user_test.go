@@ -0,0 +1,442 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/bloom"
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/database/databasetest"
+	"substack-auth/pkg/redis"
+	"substack-auth/pkg/redis/redistest"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type testEnv struct {
+	db    *databasetest.DB
+	mr    *miniredis.Miniredis
+	redis *redis.Redis
+	cfg   *config.Config
+}
+
+// newTestEnv starts an empty database and Redis shared by the services
+// created with env.service, each of which stands for one replica.
+func newTestEnv(t *testing.T, configure func(*config.Config)) *testEnv {
+	t.Helper()
+
+	mr, r, cfg := redistest.New(t, configure)
+	return &testEnv{db: databasetest.New(t), mr: mr, redis: r, cfg: cfg}
+}
+
+func (env *testEnv) service(t *testing.T) *UserService {
+	t.Helper()
+
+	c, err := codec.New(env.cfg)
+	if err != nil {
+		t.Fatalf("codec.New: %v", err)
+	}
+	return NewUserService(env.db.Database, env.redis, c, env.cfg)
+}
+
+func (env *testEnv) cached(t *testing.T, username string) *codec.Entry {
+	t.Helper()
+
+	data, err := env.redis.Get(context.Background(), username)
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	entry, err := codec.Decode([]byte(data))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return entry
+}
+
+func withFillLock(cfg *config.Config) {
+	cfg.Features.FillLockEnabled = true
+}
+
+func TestConcurrentMissesShareOneLoad(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	env.db.SetLatency(50 * time.Millisecond)
+	s := env.service(t)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+				t.Errorf("GetByUsername: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := env.db.Queries(); got != 1 {
+		t.Errorf("database queries = %d, want 1", got)
+	}
+	if stats := s.Stats(); stats.DatabaseLoads != 1 || stats.Coalesced != stats.CacheMisses-1 {
+		t.Errorf("stats = %+v, want one load and the other misses coalesced", stats)
+	}
+}
+
+func TestFillLockWaiterServedFromCache(t *testing.T) {
+	env := newTestEnv(t, withFillLock)
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	env.db.SetLatency(200 * time.Millisecond)
+	holder, waiter := env.service(t), env.service(t)
+
+	done := make(chan error)
+	go func() {
+		_, err := holder.GetByUsername("test@katakode.com")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	user, err := waiter.GetByUsername("test@katakode.com")
+	if err != nil {
+		t.Fatalf("waiter GetByUsername: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("holder GetByUsername: %v", err)
+	}
+
+	if user.Username != "test@katakode.com" {
+		t.Errorf("waiter got %q", user.Username)
+	}
+	if got := env.db.Queries(); got != 1 {
+		t.Errorf("database queries = %d, want 1", got)
+	}
+	if stats := waiter.Stats(); stats.FillLockContended != 1 || stats.FillLockServedCache != 1 || stats.DatabaseLoads != 0 {
+		t.Errorf("waiter stats = %+v, want served from the holder's fill", stats)
+	}
+}
+
+func TestFillLockHolderBypassesRefreshQueue(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		withFillLock(cfg)
+		cfg.Features.RefreshQueueEnabled = true
+	})
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	env.db.SetLatency(200 * time.Millisecond)
+	holder, waiter := env.service(t), env.service(t)
+
+	go holder.GetByUsername("test@katakode.com")
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := waiter.GetByUsername("test@katakode.com"); err != nil {
+		t.Fatalf("waiter GetByUsername: %v", err)
+	}
+	if waited := time.Since(start); waited >= env.cfg.FillLock.TTL {
+		t.Errorf("waiter waited %s, the whole fill lock TTL", waited)
+	}
+	if stats := waiter.Stats(); stats.FillLockServedCache != 1 {
+		t.Errorf("waiter stats = %+v, want served from the holder's fill", stats)
+	}
+	if n, _ := env.redis.RefreshQueueLen(context.Background()); n != 0 {
+		t.Errorf("refresh queue holds %d users, want the holder to write directly", n)
+	}
+}
+
+func TestFillLockWaiterStopsOnMissingMarker(t *testing.T) {
+	env := newTestEnv(t, withFillLock)
+	env.db.SetLatency(200 * time.Millisecond)
+	holder, waiter := env.service(t), env.service(t)
+
+	go holder.GetByUsername("nobody@katakode.com")
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := waiter.GetByUsername("nobody@katakode.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GetByUsername err = %v, want %v", err, ErrUserNotFound)
+	}
+	if elapsed := time.Since(start); elapsed >= env.cfg.FillLock.TTL {
+		t.Errorf("waiter gave up after %v, want before the lock expired", elapsed)
+	}
+	if stats := waiter.Stats(); stats.FillLockNotFound != 1 || stats.DatabaseLoads != 0 {
+		t.Errorf("waiter stats = %+v, want not found without a database load", stats)
+	}
+}
+
+func TestFillLockWaiterLoadsAfterExpiry(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		withFillLock(cfg)
+		cfg.FillLock.TTL = 100 * time.Millisecond
+	})
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	s := env.service(t)
+
+	// A holder that crashed before filling the cache.
+	if _, ok, err := env.redis.AcquireLock(context.Background(), "fill:"+env.redis.KeyFor("test@katakode.com"), time.Minute); err != nil || !ok {
+		t.Fatalf("AcquireLock = %v, %v", ok, err)
+	}
+
+	if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if stats := s.Stats(); stats.FillLockContended != 1 || stats.DatabaseLoads != 1 {
+		t.Errorf("stats = %+v, want a database load after waiting out the lock", stats)
+	}
+	if env.cached(t, "test@katakode.com") == nil {
+		t.Error("user was not cached")
+	}
+}
+
+func withBreaker(cfg *config.Config) {
+	cfg.Features.CircuitBreakerEnabled = true
+	cfg.CircuitBreaker.FailureThreshold = 2
+	cfg.CircuitBreaker.OpenTimeout = 50 * time.Millisecond
+}
+
+func TestBreakerFallsBackToDatabase(t *testing.T) {
+	env := newTestEnv(t, withBreaker)
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	s := env.service(t)
+
+	env.mr.SetError("ERR simulated outage")
+	for range 3 {
+		if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+			t.Fatalf("GetByUsername with Redis down: %v", err)
+		}
+	}
+	if stats := s.Stats(); stats.BreakerState != "open" || stats.BreakerOpened != 1 || stats.BreakerRejected == 0 {
+		t.Fatalf("stats = %+v, want the breaker open and rejecting calls", stats)
+	}
+
+	env.mr.SetError("")
+	time.Sleep(2 * env.cfg.CircuitBreaker.OpenTimeout)
+	if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+		t.Fatalf("GetByUsername after recovery: %v", err)
+	}
+	if stats := s.Stats(); stats.BreakerState != "closed" {
+		t.Errorf("breaker state = %s after Redis recovered, want closed", stats.BreakerState)
+	}
+}
+
+func TestBreakerIgnoresMisses(t *testing.T) {
+	env := newTestEnv(t, withBreaker)
+	s := env.service(t)
+
+	for range 5 {
+		if _, err := s.GetByUsername("nobody@katakode.com"); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("GetByUsername err = %v, want %v", err, ErrUserNotFound)
+		}
+	}
+	if stats := s.Stats(); stats.BreakerState != "closed" {
+		t.Errorf("breaker state = %s after cache misses, want closed", stats.BreakerState)
+	}
+}
+
+func TestRecordLoginBypassesBreaker(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		withBreaker(cfg)
+		cfg.CircuitBreaker.OpenTimeout = time.Minute
+		cfg.Features.ActivityTrackingEnabled = true
+	})
+	user := env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	s := env.service(t)
+
+	env.mr.SetError("ERR simulated outage")
+	for range 3 {
+		s.GetByUsername(user.Username)
+	}
+	if state := s.Stats().BreakerState; state != "open" {
+		t.Fatalf("breaker state = %s, want open", state)
+	}
+	env.mr.SetError("")
+
+	// The breaker stays open for a minute, so the write only lands if it
+	// does not go through it.
+	s.RecordLogin(&user)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ids, err := env.redis.ActiveUsers(context.Background(), time.Time{}, 10)
+		if err != nil {
+			t.Fatalf("ActiveUsers: %v", err)
+		}
+		if slices.Contains(ids, user.ID) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("login activity not recorded while the breaker is open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSoftExpiryOffByDefault(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	s := env.service(t)
+
+	if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if entry := env.cached(t, "test@katakode.com"); entry == nil || !entry.SoftExpiresAt.IsZero() {
+		t.Errorf("cached entry = %+v, want one without a soft expiry", entry)
+	}
+}
+
+func TestStaleEntryServedAndRefreshed(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.Redis.SoftTTL = "45m" })
+	user := env.db.AddUser("test@katakode.com", "$2a$10$new")
+	s := env.service(t)
+
+	stale := user
+	stale.PasswordHash = "$2a$10$old"
+	data, err := codec.JSON{}.Encode(&codec.Entry{User: &stale, SoftExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if err := env.redis.Set(context.Background(), user.Username, string(data)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	got, err := s.GetByUsername("test@katakode.com")
+	if err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if got.PasswordHash != "$2a$10$old" {
+		t.Errorf("PasswordHash = %q, want the stale entry served without waiting", got.PasswordHash)
+	}
+	if stats := s.Stats(); stats.StaleServed != 1 || stats.BackgroundRefreshes != 1 {
+		t.Errorf("stats = %+v, want one stale hit and one refresh", stats)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		entry := env.cached(t, "test@katakode.com")
+		if entry.User.PasswordHash == "$2a$10$new" {
+			if !entry.SoftExpiresAt.After(time.Now()) {
+				t.Errorf("refreshed entry soft expiry = %v, want in the future", entry.SoftExpiresAt)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry was not refreshed from the database")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpdatePasswordDeletesCachedEntry(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.db.AddUser("test@katakode.com", "$2a$10$old")
+	s := env.service(t)
+
+	if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if err := s.UpdatePassword("test@katakode.com", "$2a$10$new"); err != nil {
+		t.Fatalf("UpdatePassword: %v", err)
+	}
+	if entry := env.cached(t, "test@katakode.com"); entry != nil {
+		t.Errorf("cached entry = %+v after password change, want none", entry.User)
+	}
+
+	// A login that read the old row before the update caches it late.
+	stale, _ := env.db.User("test@katakode.com")
+	stale.PasswordHash = "$2a$10$old"
+	data, _ := codec.JSON{}.Encode(&codec.Entry{User: &stale})
+	if err := env.redis.Set(context.Background(), stale.Username, string(data)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	time.Sleep(staleReloadDelay + 100*time.Millisecond)
+	if entry := env.cached(t, "test@katakode.com"); entry != nil {
+		t.Errorf("stale entry %+v survived the delayed delete", entry.User)
+	}
+
+	user, err := s.GetByUsername("test@katakode.com")
+	if err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if user.PasswordHash != "$2a$10$new" {
+		t.Errorf("PasswordHash = %q, want the new hash", user.PasswordHash)
+	}
+}
+
+func TestWritesRefusedWhenCacheUnavailable(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.db.AddUser("test@katakode.com", "$2a$10$old")
+	s := env.service(t)
+
+	env.mr.SetError("ERR simulated outage")
+	if err := s.UpdatePassword("test@katakode.com", "$2a$10$new"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("UpdatePassword err = %v, want %v", err, ErrCacheUnavailable)
+	}
+	if err := s.Delete("test@katakode.com"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("Delete err = %v, want %v", err, ErrCacheUnavailable)
+	}
+
+	user, ok := env.db.User("test@katakode.com")
+	if !ok || user.PasswordHash != "$2a$10$old" {
+		t.Errorf("stored user = %+v, %v, want it unchanged", user, ok)
+	}
+}
+
+func TestDeleteRemovesCachedEntry(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	s := env.service(t)
+
+	if _, err := s.GetByUsername("test@katakode.com"); err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if err := s.Delete("test@katakode.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if entry := env.cached(t, "test@katakode.com"); entry != nil {
+		t.Errorf("cached entry = %+v after delete, want none", entry.User)
+	}
+	if _, err := s.GetByUsername("test@katakode.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetByUsername err = %v, want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestCreateWritesThrough(t *testing.T) {
+	for _, bloomEnabled := range []bool{false, true} {
+		name := "bloom disabled"
+		if bloomEnabled {
+			name = "bloom enabled"
+		}
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, func(cfg *config.Config) { cfg.Features.BloomFilterEnabled = bloomEnabled })
+			s := env.service(t)
+
+			filter := bloom.NewWithEstimates(1000, 0.01)
+			if err := env.redis.PublishBloom(context.Background(), filter); err != nil {
+				t.Fatalf("PublishBloom: %v", err)
+			}
+
+			if _, err := s.Create("new@katakode.com", "$2a$10$hash"); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if _, err := s.Create("NEW@katakode.com", "$2a$10$hash"); !errors.Is(err, ErrUserExists) {
+				t.Errorf("second Create err = %v, want %v", err, ErrUserExists)
+			}
+
+			if entry := env.cached(t, "new@katakode.com"); entry == nil || entry.User.PasswordHash != "$2a$10$hash" {
+				t.Errorf("cached entry = %+v, want the new user", entry)
+			}
+			known, err := env.redis.BloomMayContain(context.Background(), "new@katakode.com")
+			if err != nil {
+				t.Fatalf("BloomMayContain: %v", err)
+			}
+			if known != bloomEnabled {
+				t.Errorf("user in bloom filter = %v, want %v", known, bloomEnabled)
+			}
+		})
+	}
+}
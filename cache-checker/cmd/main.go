@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"substack-auth/cache-checker/internal/checker"
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/database"
+	"substack-auth/pkg/redis"
+)
+
+func main() {
+	var repair bool
+	var jsonOutput bool
+	var samples int
+	var lookup string
+
+	flag.BoolVar(&repair, "repair", false, "Rewrite missing and stale entries and delete orphaned ones")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	flag.IntVar(&samples, "samples", 10, "Number of example usernames to list per category")
+	flag.StringVar(&lookup, "lookup", "", "Show the cache key and entry for a single username instead of checking")
+	flag.Parse()
+
+	cfg := config.Load()
+
+	// Keep stdout clean for the JSON report.
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	slog.SetDefault(logger)
+
+	db, err := database.New(cfg)
+	if err != nil {
+		logger.Error("Failed to connect to database", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	redisClient, err := redis.New(cfg)
+	if err != nil {
+		logger.Error("Failed to connect to Redis", "error", err)
+		os.Exit(1)
+	}
+	defer redisClient.Close()
+
+	userCodec, err := codec.New(cfg)
+	if err != nil {
+		logger.Error("Failed to initialize cache codec", "error", err)
+		os.Exit(1)
+	}
+
+	cacheChecker := checker.New(db, redisClient, userCodec, cfg, repair, samples)
+
+	if lookup != "" {
+		result, err := cacheChecker.Lookup(context.Background(), lookup)
+		if err != nil {
+			logger.Error("Lookup failed", "username", lookup, "error", err)
+			os.Exit(1)
+		}
+		if jsonOutput {
+			printJSON(result)
+		} else {
+			printLookup(result)
+		}
+		return
+	}
+
+	report, err := cacheChecker.Run(context.Background())
+	if err != nil {
+		logger.Error("Consistency check failed", "error", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(report)
+	} else {
+		printReport(report)
+	}
+
+	if !repair && report.Missing+report.Stale+report.Orphaned > 0 {
+		os.Exit(2)
+	}
+}
+
+func printReport(report *checker.Report) {
+	fmt.Println("Cache Consistency Report")
+	fmt.Println("========================")
+	fmt.Printf("Rows checked:  %d\n", report.Checked)
+	fmt.Printf("Consistent:    %d\n", report.Consistent)
+	fmt.Printf("Missing:       %d%s\n", report.Missing, formatSamples(report.MissingSamples))
+	fmt.Printf("Stale:         %d%s\n", report.Stale, formatSamples(report.StaleSamples))
+	fmt.Printf("Orphaned:      %d%s\n", report.Orphaned, formatSamples(report.OrphanedSamples))
+	if report.Repair {
+		fmt.Printf("Repaired:      %d\n", report.Repaired)
+	}
+	fmt.Printf("Duration:      %s\n", report.Duration)
+}
+
+func formatSamples(samples []string) string {
+	if len(samples) == 0 {
+		return ""
+	}
+	return " (e.g. " + strings.Join(samples, ", ") + ")"
+}
+
+func printLookup(result *checker.Lookup) {
+	fmt.Printf("Username:      %s\n", result.Username)
+	fmt.Printf("Key:           %s\n", result.Key)
+	if result.Field != "" {
+		fmt.Printf("Field:         %s\n", result.Field)
+	}
+	if !result.Cached {
+		fmt.Println("Cached:        no")
+		return
+	}
+	fmt.Println("Cached:        yes")
+	if result.Error != "" {
+		fmt.Printf("Decode error:  %s\n", result.Error)
+		return
+	}
+	fmt.Printf("ID:            %d\n", result.ID)
+	fmt.Printf("Password hash: %t\n", result.HasHash)
+	fmt.Printf("Created at:    %s\n", result.CreatedAt)
+	if !result.SoftExpiresAt.IsZero() {
+		fmt.Printf("Soft expiry:   %s\n", result.SoftExpiresAt)
+	}
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Error("Failed to encode output", "error", err)
+		os.Exit(1)
+	}
+}
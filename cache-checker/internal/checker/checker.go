@@ -0,0 +1,299 @@
+package checker
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/database"
+	"substack-auth/pkg/models"
+	"substack-auth/pkg/redis"
+)
+
+// Report summarises how the cache differs from MySQL.
+type Report struct {
+	Checked    int  `json:"checked"`
+	Consistent int  `json:"consistent"`
+	Missing    int  `json:"missing"`
+	Stale      int  `json:"stale"`
+	Orphaned   int  `json:"orphaned"`
+	Repaired   int  `json:"repaired"`
+	Repair     bool `json:"repair"`
+
+	MissingSamples  []string `json:"missing_samples,omitempty"`
+	StaleSamples    []string `json:"stale_samples,omitempty"`
+	OrphanedSamples []string `json:"orphaned_samples,omitempty"`
+
+	Duration time.Duration `json:"duration_ns"`
+}
+
+type Checker struct {
+	db      *database.Database
+	redis   *redis.Redis
+	codec   codec.Codec
+	cfg     *config.Config
+	repair  bool
+	samples int
+
+	// known holds the stored name of every row checked, so the orphan scan
+	// only has to look up entries written since.
+	known nameSet
+}
+
+// nameSet holds 64-bit fingerprints of stored names, as the precache
+// worker's sweep does, so a million users cost tens of megabytes rather than
+// a million strings. A collision only means one orphan goes unreported.
+type nameSet map[uint64]struct{}
+
+func (s nameSet) add(name string) {
+	s[fingerprint(name)] = struct{}{}
+}
+
+func (s nameSet) has(name string) bool {
+	_, ok := s[fingerprint(name)]
+	return ok
+}
+
+func fingerprint(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+func New(db *database.Database, redis *redis.Redis, codec codec.Codec, cfg *config.Config, repair bool, samples int) *Checker {
+	return &Checker{
+		db:      db,
+		redis:   redis,
+		codec:   codec,
+		cfg:     cfg,
+		repair:  repair,
+		samples: samples,
+	}
+}
+
+// Run compares every user row with its cache entry, then scans the cache for
+// entries whose user no longer exists. With pseudonymous keys orphans are
+// reported by stored name. With repair enabled missing and stale
+// entries are rewritten from MySQL and orphans are deleted.
+func (c *Checker) Run(ctx context.Context) (*Report, error) {
+	start := time.Now()
+	report := &Report{Repair: c.repair}
+	c.known = make(nameSet)
+
+	if err := c.checkUsers(ctx, report); err != nil {
+		return nil, err
+	}
+
+	if err := c.checkOrphans(ctx, report); err != nil {
+		return nil, err
+	}
+
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+func (c *Checker) checkUsers(ctx context.Context, report *Report) error {
+	lastID := int64(0)
+
+	for {
+		users, err := c.db.UsersAfter(ctx, lastID, c.cfg.Precache.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		if len(users) == 0 {
+			break
+		}
+
+		usernames := make([]string, len(users))
+		for i, user := range users {
+			usernames[i] = user.Username
+		}
+
+		cached, err := c.redis.GetBatch(ctx, usernames)
+		if err != nil {
+			return err
+		}
+
+		var toRepair []models.User
+		for _, user := range users {
+			report.Checked++
+			c.known.add(c.redis.KeyFor(user.Username))
+
+			data, ok := cached[user.Username]
+			if !ok {
+				report.Missing++
+				report.MissingSamples = c.sample(report.MissingSamples, user.Username)
+				toRepair = append(toRepair, user)
+				continue
+			}
+
+			entry, err := c.codec.Decode([]byte(data))
+			if err != nil || !sameUser(entry.User, &user) {
+				report.Stale++
+				report.StaleSamples = c.sample(report.StaleSamples, user.Username)
+				toRepair = append(toRepair, user)
+				continue
+			}
+
+			report.Consistent++
+		}
+
+		if c.repair && len(toRepair) > 0 {
+			if err := c.rewrite(ctx, toRepair); err != nil {
+				return err
+			}
+			report.Repaired += len(toRepair)
+		}
+
+		lastID = users[len(users)-1].ID
+		slog.Debug("Checked batch", "last_id", lastID, "checked", report.Checked)
+
+		if len(users) < c.cfg.Precache.BatchSize {
+			break
+		}
+	}
+
+	return nil
+}
+
+// checkOrphans scans the cache for entries not seen by checkUsers. Each one
+// is decoded and its user looked up in MySQL, so users created during the
+// check are not reported or deleted. Entries stored under a name other than
+// their user's key, as after a key hash secret change, can never be read and
+// are orphans too. Entries that do not decode are skipped.
+func (c *Checker) checkOrphans(ctx context.Context, report *Report) error {
+	// The hash layout can report a name once per live generation.
+	seen := make(nameSet)
+
+	return c.redis.ScanKeys(ctx, func(names []string) error {
+		var candidates []string
+		for _, name := range names {
+			if c.known.has(name) || seen.has(name) {
+				continue
+			}
+			seen.add(name)
+			candidates = append(candidates, name)
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+
+		values, err := c.redis.GetNames(ctx, candidates)
+		if err != nil {
+			return err
+		}
+
+		var orphans []string
+		usernames := make(map[string]string, len(values))
+		for name, value := range values {
+			entry, err := c.codec.Decode([]byte(value))
+			if err != nil {
+				slog.Debug("Skipping unreadable cache entry", "name", name, "error", err)
+				continue
+			}
+			if c.redis.KeyFor(entry.User.Username) != name {
+				orphans = append(orphans, name)
+				continue
+			}
+			usernames[entry.User.Username] = name
+		}
+
+		existing, err := c.db.ExistingUsernames(ctx, slices.Collect(maps.Keys(usernames)))
+		if err != nil {
+			return err
+		}
+
+		for username, name := range usernames {
+			if existing[username] {
+				continue
+			}
+			orphans = append(orphans, name)
+		}
+
+		report.Orphaned += len(orphans)
+		for _, name := range orphans {
+			report.OrphanedSamples = c.sample(report.OrphanedSamples, name)
+		}
+
+		if c.repair && len(orphans) > 0 {
+			if err := c.redis.DeleteNames(ctx, orphans); err != nil {
+				return err
+			}
+			report.Repaired += len(orphans)
+		}
+		return nil
+	})
+}
+
+func (c *Checker) rewrite(ctx context.Context, users []models.User) error {
+	batchData := make(map[string]string, len(users))
+	for _, user := range users {
+		data, err := c.codec.Encode(&codec.Entry{User: &user, SoftExpiresAt: c.redis.SoftExpiry()})
+		if err != nil {
+			return err
+		}
+		batchData[user.Username] = string(data)
+	}
+	return c.redis.SetBatch(ctx, batchData)
+}
+
+func (c *Checker) sample(samples []string, username string) []string {
+	if len(samples) >= c.samples {
+		return samples
+	}
+	return append(samples, username)
+}
+
+func sameUser(cached, row *models.User) bool {
+	return cached.ID == row.ID &&
+		cached.Username == row.Username &&
+		cached.PasswordHash == row.PasswordHash &&
+		cached.CreatedAt.Equal(row.CreatedAt)
+}
+
+// Lookup describes the cache entry for a single username.
+type Lookup struct {
+	Username      string    `json:"username"`
+	Key           string    `json:"key"`
+	Field         string    `json:"field,omitempty"`
+	Cached        bool      `json:"cached"`
+	Error         string    `json:"error,omitempty"`
+	ID            int64     `json:"id,omitempty"`
+	HasHash       bool      `json:"has_password_hash"`
+	CreatedAt     time.Time `json:"created_at,omitempty"`
+	SoftExpiresAt time.Time `json:"soft_expires_at,omitempty"`
+}
+
+// Lookup resolves where username's entry lives, which is the supported way
+// to find it when keys are pseudonymous, and decodes it if present.
+func (c *Checker) Lookup(ctx context.Context, username string) (*Lookup, error) {
+	result := &Lookup{Username: username}
+	result.Key, result.Field = c.redis.Locate(username)
+
+	data, err := c.redis.Get(ctx, username)
+	if err == redis.Nil {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Cached = true
+
+	entry, err := c.codec.Decode([]byte(data))
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	result.ID = entry.User.ID
+	result.HasHash = entry.User.PasswordHash != ""
+	result.CreatedAt = entry.User.CreatedAt
+	result.SoftExpiresAt = entry.SoftExpiresAt
+	return result, nil
+}
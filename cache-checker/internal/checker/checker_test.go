@@ -0,0 +1,132 @@
+package checker
+
+import (
+	"context"
+	"testing"
+
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/database/databasetest"
+	"substack-auth/pkg/models"
+	"substack-auth/pkg/redis"
+	"substack-auth/pkg/redis/redistest"
+)
+
+func newTestChecker(t *testing.T, configure func(*config.Config)) (*Checker, *databasetest.DB, *redis.Redis) {
+	t.Helper()
+
+	_, r, cfg := redistest.New(t, configure)
+	c, err := codec.New(cfg)
+	if err != nil {
+		t.Fatalf("codec.New: %v", err)
+	}
+	db := databasetest.New(t)
+	return New(db.Database, r, c, cfg, true, 10), db, r
+}
+
+func cacheUser(t *testing.T, r *redis.Redis, user models.User) {
+	t.Helper()
+
+	data, err := codec.JSON{}.Encode(&codec.Entry{User: &user})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if err := r.Set(context.Background(), user.Username, string(data)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+}
+
+func TestRunRepairsCache(t *testing.T) {
+	checker, db, r := newTestChecker(t, nil)
+	ctx := context.Background()
+
+	consistent := db.AddUser("consistent@katakode.com", "$2a$10$hash")
+	cacheUser(t, r, consistent)
+	db.AddUser("missing@katakode.com", "$2a$10$hash")
+	stale := db.AddUser("stale@katakode.com", "$2a$10$new")
+	stale.PasswordHash = "$2a$10$old"
+	cacheUser(t, r, stale)
+	cacheUser(t, r, models.User{ID: 99, Username: "deleted@katakode.com", PasswordHash: "$2a$10$hash"})
+
+	report, err := checker.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Checked != 3 || report.Consistent != 1 || report.Missing != 1 || report.Stale != 1 || report.Orphaned != 1 || report.Repaired != 3 {
+		t.Errorf("report = %+v", report)
+	}
+	if len(report.OrphanedSamples) != 1 || report.OrphanedSamples[0] != "deleted@katakode.com" {
+		t.Errorf("orphaned samples = %v", report.OrphanedSamples)
+	}
+
+	report, err = checker.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run after repair: %v", err)
+	}
+	if report.Consistent != 3 || report.Missing+report.Stale+report.Orphaned != 0 {
+		t.Errorf("report after repair = %+v, want everything consistent", report)
+	}
+}
+
+// A user created after checkUsers passed its id is cached but was not seen;
+// it must not be reported or deleted as an orphan.
+func TestOrphansRecheckedAgainstDatabase(t *testing.T) {
+	checker, db, r := newTestChecker(t, nil)
+	ctx := context.Background()
+
+	checker.known = make(nameSet)
+	cacheUser(t, r, db.AddUser("new@katakode.com", "$2a$10$hash"))
+	// Entries in a format this checker cannot read are left alone.
+	if err := r.Set(ctx, "unreadable@katakode.com", "\xffnot a cache value"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	report := &Report{}
+	if err := checker.checkOrphans(ctx, report); err != nil {
+		t.Fatalf("checkOrphans: %v", err)
+	}
+	if report.Orphaned != 0 || report.Repaired != 0 {
+		t.Errorf("report = %+v, want no orphans", report)
+	}
+	for _, name := range []string{"new@katakode.com", "unreadable@katakode.com"} {
+		if _, err := r.Get(ctx, name); err != nil {
+			t.Errorf("Get(%q) = %v, want the entry kept", name, err)
+		}
+	}
+}
+
+func TestOrphansUnderOldKeyHashSecret(t *testing.T) {
+	withSecret := func(secret string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.Redis.KeyHashing = true
+			cfg.Redis.KeyHashSecret = secret
+		}
+	}
+	checker, db, r := newTestChecker(t, withSecret("new-secret-0123456789abcdef0123456789"))
+	ctx := context.Background()
+
+	user := db.AddUser("test@katakode.com", "$2a$10$hash")
+	cacheUser(t, r, user)
+
+	// The same user cached under the name the previous secret gave it.
+	oldCfg := *checker.cfg
+	oldCfg.Redis.KeyHashSecret = "old-secret-0123456789abcdef0123456789"
+	old, err := redis.New(&oldCfg)
+	if err != nil {
+		t.Fatalf("redis.New: %v", err)
+	}
+	defer old.Close()
+	cacheUser(t, old, user)
+	oldName := old.KeyFor(user.Username)
+
+	report, err := checker.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if report.Consistent != 1 || report.Orphaned != 1 {
+		t.Errorf("report = %+v, want the old entry orphaned", report)
+	}
+	if values, _ := r.GetNames(ctx, []string{oldName}); len(values) != 0 {
+		t.Error("entry under the old key was not deleted")
+	}
+}
@@ -0,0 +1,228 @@
+// Package binlogtest is a fake MySQL server that speaks just enough of the
+// replication protocol for package binlog: it authenticates any user,
+// answers every statement with OK and, once a binlog dump is requested,
+// streams the events handed to Send.
+package binlogtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+const (
+	nativePassword = "mysql_native_password"
+	cachingSHA2    = "caching_sha2_password"
+)
+
+// Server is a fake replication source listening on loopback.
+type Server struct {
+	// Plugin is the auth plugin the greeting announces. It defaults to
+	// mysql_native_password.
+	Plugin string
+	// SwitchTo, when set, answers the handshake response with an auth
+	// switch request to this plugin.
+	SwitchTo string
+	// FullAuth makes caching_sha2_password ask for full authentication
+	// instead of reporting a fast auth success.
+	FullAuth bool
+
+	listener net.Listener
+	events   chan []byte
+
+	mu    sync.Mutex
+	dumps int
+}
+
+// New starts a server with the default settings, adjusted by configure when
+// it is not nil. It is closed when the test ends.
+func New(t testing.TB, configure func(*Server)) *Server {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	s := &Server{
+		Plugin:   nativePassword,
+		listener: listener,
+		events:   make(chan []byte, 64),
+	}
+	if configure != nil {
+		configure(s)
+	}
+
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *Server) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Send queues a binlog event, header included, for the dump stream.
+func (s *Server) Send(event []byte) {
+	s.events <- event
+}
+
+// Dumps returns the number of binlog dumps requested so far.
+func (s *Server) Dumps() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dumps
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(netConn net.Conn) {
+	defer netConn.Close()
+
+	c := &conn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if err := s.authenticate(c); err != nil {
+		return
+	}
+
+	for {
+		c.seq = 0
+		packet, err := c.read()
+		if err != nil || len(packet) == 0 {
+			return
+		}
+
+		switch packet[0] {
+		case 0x03: // COM_QUERY
+			if c.write(okPacket) != nil {
+				return
+			}
+		case 0x12: // COM_BINLOG_DUMP
+			s.mu.Lock()
+			s.dumps++
+			s.mu.Unlock()
+			s.stream(c)
+			return
+		default:
+			c.write([]byte{0xff, 0x2f, 0x04, 'u', 'n', 'k', 'n', 'o', 'w', 'n'})
+			return
+		}
+	}
+}
+
+func (s *Server) authenticate(c *conn) error {
+	salt := []byte("0123456789abcdefghij")
+
+	greeting := []byte{10}
+	greeting = append(greeting, "8.0.36-binlogtest"...)
+	greeting = append(greeting, 0)
+	greeting = binary.LittleEndian.AppendUint32(greeting, 1)
+	greeting = append(greeting, salt[:8]...)
+	greeting = append(greeting, 0)
+	greeting = binary.LittleEndian.AppendUint16(greeting, 0xf7ff) // capabilities, low half
+	greeting = append(greeting, 45)
+	greeting = binary.LittleEndian.AppendUint16(greeting, 0x0002) // status
+	greeting = binary.LittleEndian.AppendUint16(greeting, 0x008f) // capabilities, high half: plugin auth
+	greeting = append(greeting, byte(len(salt)+1))
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, salt[8:]...)
+	greeting = append(greeting, 0)
+	greeting = append(greeting, s.Plugin...)
+	greeting = append(greeting, 0)
+
+	if err := c.write(greeting); err != nil {
+		return err
+	}
+	if _, err := c.read(); err != nil {
+		return err
+	}
+
+	plugin := s.Plugin
+	if s.SwitchTo != "" {
+		plugin = s.SwitchTo
+		request := append([]byte{0xfe}, plugin...)
+		request = append(request, 0)
+		request = append(request, salt...)
+		request = append(request, 0)
+		if err := c.write(request); err != nil {
+			return err
+		}
+		if _, err := c.read(); err != nil {
+			return err
+		}
+	}
+
+	if plugin == cachingSHA2 {
+		if s.FullAuth {
+			c.write([]byte{0x01, 0x04})
+			// The client has no way to continue without TLS.
+			return io.EOF
+		}
+		if err := c.write([]byte{0x01, 0x03}); err != nil {
+			return err
+		}
+	}
+	return c.write(okPacket)
+}
+
+// stream writes queued events until the client hangs up, so a later dump
+// gets the events sent after it.
+func (s *Server) stream(c *conn) {
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, c.reader)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case event := <-s.events:
+			if err := c.write(append([]byte{0x00}, event...)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+var okPacket = []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+
+type conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    byte
+}
+
+func (c *conn) read() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+	c.seq = header[3] + 1
+
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err := io.ReadFull(c.reader, payload)
+	return payload, err
+}
+
+func (c *conn) write(payload []byte) error {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), c.seq}
+	c.seq++
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
@@ -0,0 +1,474 @@
+// Package binlog is a minimal MySQL replication client. It connects as a
+// replica, requests a row-based binlog stream from a given position and
+// decodes the events needed to follow changes to a table: rotations, table
+// maps, row changes and transaction commits. Connections are not encrypted,
+// so caching_sha2_password users must already be in the server's auth cache;
+// full authentication, like any other unsupported feature, fails with an
+// error wrapping ErrUnsupported.
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	comQuery      = 0x03
+	comBinlogDump = 0x12
+
+	clientLongPassword     = 0x00000001
+	clientLongFlag         = 0x00000004
+	clientProtocol41       = 0x00000200
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+
+	charsetUTF8MB4 = 45
+	maxPacketSize  = 1<<24 - 1
+
+	nativePassword = "mysql_native_password"
+	cachingSHA2    = "caching_sha2_password"
+
+	// errMasterFatalReadingBinlog is returned when the requested binlog file
+	// or position no longer exists on the server.
+	errMasterFatalReadingBinlog = 1236
+)
+
+// Config describes the server to replicate from.
+type Config struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+
+	// ServerID identifies this replica; it must differ from the server's and
+	// from every other replica's.
+	ServerID uint32
+
+	// Heartbeat asks the server to send a heartbeat when the stream is idle
+	// for this long, so a dead connection is noticed. Zero disables it.
+	Heartbeat time.Duration
+
+	// Tables limits row decoding to the listed tables, each given as
+	// "schema.table". Row events for any other table are returned with their
+	// Table but without Rows. Empty decodes every table.
+	Tables []string
+}
+
+// ErrUnsupported is wrapped by errors for server settings this client cannot
+// handle. Reconnecting does not help; the setting has to change.
+var ErrUnsupported = errors.New("not supported by the binlog client")
+
+// Position is a location in the binlog: the file name and the byte offset
+// of the next event to read.
+type Position struct {
+	File string
+	Pos  uint32
+}
+
+func (p Position) String() string {
+	return p.File + ":" + strconv.FormatUint(uint64(p.Pos), 10)
+}
+
+// ParsePosition parses the form produced by Position.String.
+func ParsePosition(s string) (Position, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return Position{}, fmt.Errorf("invalid binlog position %q", s)
+	}
+	pos, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return Position{}, fmt.Errorf("invalid binlog position %q: %w", s, err)
+	}
+	return Position{File: s[:i], Pos: uint32(pos)}, nil
+}
+
+// Error is an error packet sent by the server.
+type Error struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("mysql error %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+// IsPositionLost reports whether err means the requested binlog position
+// is gone, typically because the file was purged.
+func IsPositionLost(err error) bool {
+	var mysqlErr *Error
+	return errors.As(err, &mysqlErr) && mysqlErr.Code == errMasterFatalReadingBinlog
+}
+
+// Conn is a replication connection. It is not safe for concurrent use.
+type Conn struct {
+	cfg      Config
+	conn     net.Conn
+	reader   *bufio.Reader
+	seq      byte
+	checksum bool
+	// formatSeen is set once the format description event arrived; from then
+	// on every event carries a checksum when checksums are enabled.
+	formatSeen bool
+	tables     map[uint64]*Table
+	position   Position
+	// watched holds the "schema.table" names from Config.Tables.
+	watched map[string]bool
+}
+
+// Dial connects and authenticates to the server described by cfg.
+func Dial(ctx context.Context, cfg Config) (*Conn, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		cfg:    cfg,
+		conn:   netConn,
+		reader: bufio.NewReaderSize(netConn, 64*1024),
+		tables: make(map[uint64]*Table),
+	}
+	if len(cfg.Tables) > 0 {
+		c.watched = make(map[string]bool, len(cfg.Tables))
+		for _, name := range cfg.Tables {
+			c.watched[name] = true
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	if err := c.handshake(); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("mysql handshake: %w", err)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Dump starts streaming events from pos. checksum must match the server's
+// binlog_checksum setting (CRC32 or NONE).
+func (c *Conn) Dump(pos Position, checksum string) error {
+	c.checksum = strings.EqualFold(checksum, "CRC32")
+
+	if err := c.exec("SET @master_binlog_checksum = '" + strings.ToUpper(checksum) + "'"); err != nil {
+		return err
+	}
+	if c.cfg.Heartbeat > 0 {
+		if err := c.exec(fmt.Sprintf("SET @master_heartbeat_period = %d", c.cfg.Heartbeat.Nanoseconds())); err != nil {
+			return err
+		}
+	}
+
+	payload := make([]byte, 0, 11+len(pos.File))
+	payload = append(payload, comBinlogDump)
+	payload = binary.LittleEndian.AppendUint32(payload, pos.Pos)
+	payload = binary.LittleEndian.AppendUint16(payload, 0)
+	payload = binary.LittleEndian.AppendUint32(payload, c.cfg.ServerID)
+	payload = append(payload, pos.File...)
+
+	c.seq = 0
+	c.position = pos
+	c.formatSeen = false
+	return c.writePacket(payload)
+}
+
+// Next blocks until the next event arrives. Cancelling ctx closes the
+// connection and makes Next return.
+func (c *Conn) Next(ctx context.Context) (*Event, error) {
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	for {
+		if c.cfg.Heartbeat > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(3 * c.cfg.Heartbeat))
+		}
+
+		packet, err := c.readPacket()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		switch packet[0] {
+		case 0x00:
+		case 0xff:
+			return nil, parseError(packet)
+		case 0xfe:
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("unexpected binlog packet 0x%02x", packet[0])
+		}
+
+		event, err := c.parseEvent(packet[1:])
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			return event, nil
+		}
+	}
+}
+
+// exec runs a statement that returns no rows.
+func (c *Conn) exec(query string) error {
+	c.seq = 0
+	if err := c.writePacket(append([]byte{comQuery}, query...)); err != nil {
+		return err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if packet[0] == 0xff {
+		return parseError(packet)
+	}
+	if packet[0] != 0x00 {
+		return fmt.Errorf("unexpected response to %q", query)
+	}
+	return nil
+}
+
+func (c *Conn) handshake() error {
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if packet[0] == 0xff {
+		return parseError(packet)
+	}
+	if packet[0] != 10 {
+		return fmt.Errorf("unsupported protocol version %d", packet[0])
+	}
+
+	// protocol version, server version, connection id
+	rest := packet[1:]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 || len(rest) < end+1+4+8+1+2 {
+		return errors.New("malformed handshake")
+	}
+	rest = rest[end+1+4:]
+
+	salt := append([]byte(nil), rest[:8]...)
+	rest = rest[8+1:]
+	capabilities := uint32(binary.LittleEndian.Uint16(rest))
+	rest = rest[2:]
+
+	plugin := nativePassword
+	if len(rest) >= 16 {
+		capabilities |= uint32(binary.LittleEndian.Uint16(rest[3:])) << 16
+		saltLen := int(rest[5])
+		rest = rest[16:]
+
+		n := max(13, saltLen-8)
+		if len(rest) < n {
+			return errors.New("malformed handshake")
+		}
+		salt = append(salt, bytes.TrimRight(rest[:n], "\x00")...)
+		rest = rest[n:]
+
+		if capabilities&clientPluginAuth != 0 {
+			if i := bytes.IndexByte(rest, 0); i >= 0 {
+				plugin = string(rest[:i])
+			} else {
+				plugin = string(rest)
+			}
+		}
+	}
+	if capabilities&clientProtocol41 == 0 {
+		return errors.New("server does not support protocol 4.1")
+	}
+	if plugin != cachingSHA2 {
+		// The server switches to the user's plugin if it differs; a plugin
+		// the client cannot answer then fails in scramble.
+		plugin = nativePassword
+	}
+
+	authData, err := c.scramble(plugin, salt)
+	if err != nil {
+		return err
+	}
+
+	response := make([]byte, 0, 64+len(c.cfg.User)+len(authData))
+	response = binary.LittleEndian.AppendUint32(response,
+		clientLongPassword|clientLongFlag|clientProtocol41|clientTransactions|clientSecureConnection|clientPluginAuth)
+	response = binary.LittleEndian.AppendUint32(response, maxPacketSize)
+	response = append(response, charsetUTF8MB4)
+	response = append(response, make([]byte, 23)...)
+	response = append(response, c.cfg.User...)
+	response = append(response, 0, byte(len(authData)))
+	response = append(response, authData...)
+	response = append(response, plugin...)
+	response = append(response, 0)
+
+	if err := c.writePacket(response); err != nil {
+		return err
+	}
+	return c.finishAuth(plugin)
+}
+
+// finishAuth handles the server's reply to the handshake response,
+// including a switch to another authentication method.
+func (c *Conn) finishAuth(plugin string) error {
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch packet[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return parseError(packet)
+		case 0xfe:
+			// auth switch request: plugin name, then the new salt
+			body := packet[1:]
+			i := bytes.IndexByte(body, 0)
+			if i < 0 {
+				return errors.New("malformed auth switch request")
+			}
+			plugin = string(body[:i])
+			salt := bytes.TrimRight(body[i+1:], "\x00")
+
+			authData, err := c.scramble(plugin, salt)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(authData); err != nil {
+				return err
+			}
+		case 0x01:
+			// caching_sha2_password: 3 = fast auth succeeded, OK follows;
+			// 4 = full auth, which needs TLS or RSA key exchange.
+			if plugin == cachingSHA2 && len(packet) > 1 && packet[1] == 3 {
+				continue
+			}
+			return fmt.Errorf("%w: %s full authentication needs TLS or RSA key exchange; use %s for the replication user", ErrUnsupported, plugin, nativePassword)
+		default:
+			return fmt.Errorf("unexpected auth response 0x%02x", packet[0])
+		}
+	}
+}
+
+func (c *Conn) scramble(plugin string, salt []byte) ([]byte, error) {
+	if c.cfg.Password == "" {
+		return nil, nil
+	}
+	if len(salt) > 20 {
+		salt = salt[:20]
+	}
+
+	switch plugin {
+	case nativePassword:
+		// SHA1(password) XOR SHA1(salt + SHA1(SHA1(password)))
+		stage1 := sha1.Sum([]byte(c.cfg.Password))
+		stage2 := sha1.Sum(stage1[:])
+		h := sha1.New()
+		h.Write(salt)
+		h.Write(stage2[:])
+		return xor(stage1[:], h.Sum(nil)), nil
+	case cachingSHA2:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt)
+		stage1 := sha256.Sum256([]byte(c.cfg.Password))
+		stage2 := sha256.Sum256(stage1[:])
+		h := sha256.New()
+		h.Write(stage2[:])
+		h.Write(salt)
+		return xor(stage1[:], h.Sum(nil)), nil
+	default:
+		return nil, fmt.Errorf("%w: auth plugin %q", ErrUnsupported, plugin)
+	}
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// readPacket reads one logical packet, joining payloads split at the
+// maximum packet size.
+func (c *Conn) readPacket() ([]byte, error) {
+	var payload []byte
+	header := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.seq = header[3] + 1
+
+		start := len(payload)
+		payload = append(payload, make([]byte, length)...)
+		if _, err := io.ReadFull(c.reader, payload[start:]); err != nil {
+			return nil, err
+		}
+
+		if length < maxPacketSize {
+			break
+		}
+	}
+
+	if len(payload) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	return payload, nil
+}
+
+func (c *Conn) writePacket(payload []byte) error {
+	for {
+		n := min(len(payload), maxPacketSize)
+		header := []byte{byte(n), byte(n >> 8), byte(n >> 16), c.seq}
+		c.seq++
+
+		if _, err := c.conn.Write(append(header, payload[:n]...)); err != nil {
+			return err
+		}
+
+		payload = payload[n:]
+		if n < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+func parseError(packet []byte) error {
+	if len(packet) < 3 {
+		return errors.New("malformed error packet")
+	}
+
+	e := &Error{Code: binary.LittleEndian.Uint16(packet[1:])}
+	msg := packet[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		e.State = string(msg[1:6])
+		msg = msg[6:]
+	}
+	e.Message = string(msg)
+	return e
+}
@@ -0,0 +1,72 @@
+package binlog
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"substack-auth/pkg/binlog/binlogtest"
+)
+
+func TestDialAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		configure   func(*binlogtest.Server)
+		unsupported bool
+	}{
+		{"native password", nil, false},
+		{"caching sha2 fast auth", func(s *binlogtest.Server) { s.Plugin = cachingSHA2 }, false},
+		{"switch to native password", func(s *binlogtest.Server) { s.Plugin = cachingSHA2; s.SwitchTo = nativePassword }, false},
+		{"caching sha2 full auth", func(s *binlogtest.Server) { s.Plugin = cachingSHA2; s.FullAuth = true }, true},
+		{"switch to unknown plugin", func(s *binlogtest.Server) { s.SwitchTo = "sha256_password" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := binlogtest.New(t, tt.configure)
+
+			conn, err := Dial(context.Background(), Config{
+				Host:     server.Host(),
+				Port:     server.Port(),
+				User:     "repl",
+				Password: "secret",
+				ServerID: 1001,
+			})
+			if tt.unsupported {
+				if !errors.Is(err, ErrUnsupported) {
+					t.Errorf("Dial err = %v, want %v", err, ErrUnsupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestDumpStreamsEvents(t *testing.T) {
+	server := binlogtest.New(t, nil)
+	conn, err := Dial(context.Background(), Config{Host: server.Host(), Port: server.Port(), User: "repl", ServerID: 1001})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Dump(Position{File: "binlog.000003", Pos: 1000}, "CRC32"); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+	// The stream starts after the format description, so the table map's
+	// checksum must be verified.
+	conn.formatSeen = true
+	server.Send(usersTableMap)
+
+	event, err := conn.Next(context.Background())
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if event.Type != TableMapEvent || event.Table.Name != "users" {
+		t.Errorf("event = %d for %+v, want a table map for users", event.Type, event.Table)
+	}
+}
@@ -0,0 +1,237 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// EventType is the binlog event type code.
+type EventType byte
+
+const (
+	QueryEvent             EventType = 2
+	RotateEvent            EventType = 4
+	FormatDescriptionEvent EventType = 15
+	XIDEvent               EventType = 16
+	TableMapEvent          EventType = 19
+	HeartbeatEvent         EventType = 27
+	WriteRowsEvent         EventType = 30
+	UpdateRowsEvent        EventType = 31
+	DeleteRowsEvent        EventType = 32
+	// TransactionPayloadEvent wraps a whole transaction compressed with
+	// binlog_transaction_compression; the client cannot decode it.
+	TransactionPayloadEvent EventType = 40
+)
+
+const eventHeaderSize = 19
+
+// Event is a decoded binlog event. Only the fields relevant to its type are
+// set: Table for table maps and row events, Rows for row events.
+type Event struct {
+	Type      EventType
+	Timestamp uint32
+
+	// Position is where the stream continues after this event. After an
+	// XIDEvent it is a safe point to resume from.
+	Position Position
+
+	Table *Table
+	Rows  []Row
+}
+
+// Table describes a table as announced by a table map event. Columns is nil
+// for tables outside Config.Tables.
+type Table struct {
+	ID      uint64
+	Schema  string
+	Name    string
+	Columns []Column
+
+	// ignored is set for tables outside Config.Tables, whose rows are not
+	// decoded.
+	ignored bool
+}
+
+// Column is the binlog type of a table column. Names are not part of the
+// default binlog metadata; callers map columns by ordinal position.
+type Column struct {
+	Type byte
+	Meta uint16
+}
+
+// Row is one changed row. Before is nil for inserts and After is nil for
+// deletes. Values are indexed by column ordinal; columns missing from the
+// row image or holding NULL are nil.
+type Row struct {
+	Before []any
+	After  []any
+}
+
+// parseEvent decodes an event. It returns nil for events that only update
+// connection state.
+func (c *Conn) parseEvent(data []byte) (*Event, error) {
+	if len(data) < eventHeaderSize {
+		return nil, errors.New("short binlog event")
+	}
+
+	eventType := EventType(data[4])
+	nextPos := binary.LittleEndian.Uint32(data[13:])
+
+	if c.checksum && len(data) >= eventHeaderSize+4 {
+		body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+		switch {
+		case crc32.ChecksumIEEE(body) == sum:
+			data = body
+		case c.formatSeen:
+			return nil, fmt.Errorf("binlog event checksum mismatch at %s", c.position)
+		}
+		// Before the format description some servers send the initial
+		// rotate event without a checksum.
+	}
+
+	event := &Event{
+		Type:      eventType,
+		Timestamp: binary.LittleEndian.Uint32(data),
+	}
+	body := data[eventHeaderSize:]
+
+	switch eventType {
+	case RotateEvent:
+		if len(body) < 8 {
+			return nil, errors.New("short rotate event")
+		}
+		c.position = Position{
+			File: string(body[8:]),
+			Pos:  uint32(binary.LittleEndian.Uint64(body)),
+		}
+		event.Position = c.position
+		return event, nil
+
+	case FormatDescriptionEvent:
+		c.formatSeen = true
+		return nil, nil
+
+	case HeartbeatEvent:
+		return nil, nil
+
+	case TransactionPayloadEvent:
+		return nil, fmt.Errorf("%w: compressed transaction at %s; set binlog_transaction_compression=OFF", ErrUnsupported, c.position)
+
+	case TableMapEvent:
+		table, err := c.parseTableMap(body)
+		if err != nil {
+			return nil, err
+		}
+		c.tables[table.ID] = table
+		event.Table = table
+
+	case WriteRowsEvent, UpdateRowsEvent, DeleteRowsEvent:
+		table, rows, err := c.parseRows(eventType, body)
+		if err != nil {
+			return nil, err
+		}
+		event.Table = table
+		event.Rows = rows
+	}
+
+	// Artificial events carry no position; they do not move the stream.
+	if nextPos > 0 {
+		c.position.Pos = nextPos
+	}
+	event.Position = c.position
+	return event, nil
+}
+
+func (c *Conn) parseTableMap(body []byte) (*Table, error) {
+	r := &reader{data: body}
+
+	table := &Table{ID: r.uint48()}
+	r.skip(2) // flags
+	table.Schema = string(r.bytes(int(r.byte())))
+	r.skip(1)
+	table.Name = string(r.bytes(int(r.byte())))
+	r.skip(1)
+	if r.err != nil {
+		return nil, fmt.Errorf("table map: %w", r.err)
+	}
+
+	// Column metadata of other tables may use types the decoder does not
+	// know, so it is not read at all.
+	if c.watched != nil && !c.watched[table.Schema+"."+table.Name] {
+		table.ignored = true
+		return table, nil
+	}
+
+	count := int(r.lenenc())
+	types := r.bytes(count)
+	meta := &reader{data: r.bytes(int(r.lenenc()))}
+	if r.err != nil {
+		return nil, fmt.Errorf("table map: %w", r.err)
+	}
+
+	table.Columns = make([]Column, count)
+	for i, t := range types {
+		table.Columns[i] = Column{Type: t, Meta: columnMeta(t, meta)}
+	}
+	if meta.err != nil {
+		return nil, fmt.Errorf("table map %s.%s metadata: %w", table.Schema, table.Name, meta.err)
+	}
+	return table, nil
+}
+
+func (c *Conn) parseRows(eventType EventType, body []byte) (*Table, []Row, error) {
+	r := &reader{data: body}
+
+	tableID := r.uint48()
+	r.skip(2) // flags
+	extra := int(r.uint16())
+	r.skip(extra - 2)
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("rows event header: %w", r.err)
+	}
+
+	table, ok := c.tables[tableID]
+	if !ok {
+		return nil, nil, fmt.Errorf("rows event for unknown table id %d", tableID)
+	}
+	if table.ignored {
+		return table, nil, nil
+	}
+
+	count := int(r.lenenc())
+	if count != len(table.Columns) {
+		return nil, nil, fmt.Errorf("rows event for %s.%s has %d columns, table map has %d", table.Schema, table.Name, count, len(table.Columns))
+	}
+
+	present := r.bytes((count + 7) / 8)
+	presentAfter := present
+	if eventType == UpdateRowsEvent {
+		presentAfter = r.bytes((count + 7) / 8)
+	}
+
+	var rows []Row
+	for r.err == nil && r.remaining() > 0 {
+		before := r.remaining()
+		var row Row
+		switch eventType {
+		case WriteRowsEvent:
+			row.After = r.rowImage(table, presentAfter)
+		case DeleteRowsEvent:
+			row.Before = r.rowImage(table, present)
+		case UpdateRowsEvent:
+			row.Before = r.rowImage(table, present)
+			row.After = r.rowImage(table, presentAfter)
+		}
+		if r.remaining() == before {
+			// A row image that consumes nothing would repeat forever.
+			r.fail(errors.New("empty row image"))
+		}
+		rows = append(rows, row)
+	}
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("rows event for %s.%s: %w", table.Schema, table.Name, r.err)
+	}
+	return table, rows, nil
+}
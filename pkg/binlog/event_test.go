@@ -0,0 +1,275 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Events for the users table in schema.sql as sent by MySQL 8 with
+// binlog_checksum=CRC32, starting at position 1000.
+var (
+	usersTableMap = mustHex("00f1536513010000003a0000002204000000005b000000000001000461757468000575736572730005080f0f111106fc03fc03000608de9b2df9")
+	usersInsert   = mustHex("00f153651e01000000570000007904000000005b000000000001000200051f002a00000000000000110074657374406b6174616b6f64652e636f6d0b0024326124313024686173686553f1006553f10001e2402fbc3da5")
+	usersUpdate   = mustHex("00f153651f010000008e0000000705000000005b000000000001000200051f1f002a00000000000000110074657374406b6174616b6f64652e636f6d0b0024326124313024686173686553f1006553f10001e240002a00000000000000110074657374406b6174616b6f64652e636f6d0d00243261243130247265686173686553f1006553f1640000006634e0c6")
+	usersDelete   = mustHex("00f153652001000000590000006005000000005b000000000001000200051f002a00000000000000110074657374406b6174616b6f64652e636f6d0d00243261243130247265686173686553f1006553f1640000002b06bd02")
+)
+
+var (
+	usersColumns = []Column{
+		{Type: typeLongLong},
+		{Type: typeVarchar, Meta: 1020},
+		{Type: typeVarchar, Meta: 1020},
+		{Type: typeTimestamp2},
+		{Type: typeTimestamp2, Meta: 6},
+	}
+	userRow = []any{
+		int64(42), "test@katakode.com", "$2a$10$hash",
+		time.Unix(1700000000, 0).UTC(), time.Unix(1700000000, 123456000).UTC(),
+	}
+	rehashedUserRow = []any{
+		int64(42), "test@katakode.com", "$2a$10$rehash",
+		time.Unix(1700000000, 0).UTC(), time.Unix(1700000100, 0).UTC(),
+	}
+)
+
+func newTestConn() *Conn {
+	return &Conn{
+		checksum:   true,
+		formatSeen: true,
+		tables:     make(map[uint64]*Table),
+		position:   Position{File: "binlog.000003", Pos: 1000},
+	}
+}
+
+// withoutChecksum strips the CRC32 trailer so truncated copies fail in the
+// decoder rather than on the checksum.
+func withoutChecksum(event []byte) []byte {
+	return event[:len(event)-4]
+}
+
+func TestParseTableMap(t *testing.T) {
+	c := newTestConn()
+
+	event, err := c.parseEvent(usersTableMap)
+	if err != nil {
+		t.Fatalf("parseEvent: %v", err)
+	}
+
+	want := &Table{ID: 91, Schema: "auth", Name: "users", Columns: usersColumns}
+	if !reflect.DeepEqual(event.Table, want) {
+		t.Errorf("table = %+v, want %+v", event.Table, want)
+	}
+	if c.tables[91] != event.Table {
+		t.Error("table map was not remembered")
+	}
+	if event.Position.Pos != 1058 {
+		t.Errorf("position = %d, want 1058", event.Position.Pos)
+	}
+}
+
+func TestParseRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    []byte
+		wantType EventType
+		want     []Row
+		wantPos  uint32
+	}{
+		{"insert", usersInsert, WriteRowsEvent, []Row{{After: userRow}}, 1145},
+		{"update", usersUpdate, UpdateRowsEvent, []Row{{Before: userRow, After: rehashedUserRow}}, 1287},
+		{"delete", usersDelete, DeleteRowsEvent, []Row{{Before: rehashedUserRow}}, 1376},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConn()
+			if _, err := c.parseEvent(usersTableMap); err != nil {
+				t.Fatalf("parseEvent table map: %v", err)
+			}
+
+			event, err := c.parseEvent(tt.event)
+			if err != nil {
+				t.Fatalf("parseEvent: %v", err)
+			}
+			if event.Type != tt.wantType {
+				t.Errorf("type = %d, want %d", event.Type, tt.wantType)
+			}
+			if event.Table.Name != "users" {
+				t.Errorf("table = %q, want users", event.Table.Name)
+			}
+			if !reflect.DeepEqual(event.Rows, tt.want) {
+				t.Errorf("rows = %+v, want %+v", event.Rows, tt.want)
+			}
+			if event.Position.Pos != tt.wantPos {
+				t.Errorf("position = %d, want %d", event.Position.Pos, tt.wantPos)
+			}
+		})
+	}
+}
+
+func TestParseRowsUnknownTable(t *testing.T) {
+	c := newTestConn()
+
+	_, err := c.parseEvent(usersInsert)
+	if err == nil || !strings.Contains(err.Error(), "unknown table id 91") {
+		t.Errorf("parseEvent err = %v, want unknown table id 91", err)
+	}
+}
+
+func TestParseRowsIgnoredTable(t *testing.T) {
+	c := newTestConn()
+	c.watched = map[string]bool{"auth.precache_state": true}
+
+	event, err := c.parseEvent(usersTableMap)
+	if err != nil {
+		t.Fatalf("parseEvent table map: %v", err)
+	}
+	if event.Table.Name != "users" || event.Table.Columns != nil {
+		t.Errorf("table = %+v, want users without columns", event.Table)
+	}
+
+	event, err = c.parseEvent(usersInsert)
+	if err != nil {
+		t.Fatalf("parseEvent: %v", err)
+	}
+	if event.Table.Name != "users" || event.Rows != nil {
+		t.Errorf("rows = %+v for %s, want none", event.Rows, event.Table.Name)
+	}
+	if event.Position.Pos != 1145 {
+		t.Errorf("position = %d, want 1145", event.Position.Pos)
+	}
+}
+
+func TestParseTransactionPayload(t *testing.T) {
+	c := newTestConn()
+	c.checksum = false
+
+	data := make([]byte, eventHeaderSize+8)
+	data[4] = byte(TransactionPayloadEvent)
+	binary.LittleEndian.PutUint32(data[13:], 1027)
+
+	if _, err := c.parseEvent(data); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("parseEvent err = %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestParseEventTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		event []byte
+		// complete is a shorter length that still decodes: the table map
+		// without its trailing null bitmap, or a rows event without rows.
+		complete int
+	}{
+		{"table map", withoutChecksum(usersTableMap), len(usersTableMap) - 5},
+		{"insert", withoutChecksum(usersInsert), eventHeaderSize + 12},
+		{"update", withoutChecksum(usersUpdate), eventHeaderSize + 13},
+		{"delete", withoutChecksum(usersDelete), eventHeaderSize + 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for n := range len(tt.event) {
+				c := newTestConn()
+				c.checksum = false
+				c.tables[91] = &Table{ID: 91, Schema: "auth", Name: "users", Columns: usersColumns}
+
+				_, err := c.parseEvent(tt.event[:n])
+				if n == tt.complete {
+					if err != nil {
+						t.Errorf("parseEvent of %d/%d bytes: %v", n, len(tt.event), err)
+					}
+					continue
+				}
+				if err == nil {
+					t.Errorf("parseEvent of %d/%d bytes succeeded, want error", n, len(tt.event))
+				}
+			}
+		})
+	}
+}
+
+func TestParseEventChecksum(t *testing.T) {
+	corrupt := append([]byte(nil), usersTableMap...)
+	corrupt[30] ^= 0xff
+
+	c := newTestConn()
+	if _, err := c.parseEvent(corrupt); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("parseEvent err = %v, want checksum mismatch", err)
+	}
+}
+
+func TestParseRotate(t *testing.T) {
+	body := binary.LittleEndian.AppendUint64(nil, 4)
+	body = append(body, "binlog.000004"...)
+
+	header := make([]byte, eventHeaderSize)
+	header[4] = byte(RotateEvent)
+	binary.LittleEndian.PutUint32(header[9:], uint32(eventHeaderSize+len(body)))
+	data := append(header, body...)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		formatSeen bool
+	}{
+		// The first rotate of a stream arrives before the format
+		// description and may carry no checksum.
+		{"before format description", data, false},
+		{"with checksum", binary.LittleEndian.AppendUint32(append([]byte(nil), data...), crc32.ChecksumIEEE(data)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConn()
+			c.formatSeen = tt.formatSeen
+
+			event, err := c.parseEvent(tt.data)
+			if err != nil {
+				t.Fatalf("parseEvent: %v", err)
+			}
+			want := Position{File: "binlog.000004", Pos: 4}
+			if event.Position != want || c.position != want {
+				t.Errorf("position = %v, conn at %v, want %v", event.Position, c.position, want)
+			}
+		})
+	}
+}
+
+func TestParseRowsEmptyImage(t *testing.T) {
+	c := newTestConn()
+	c.checksum = false
+	c.tables[91] = &Table{ID: 91, Schema: "auth", Name: "users", Columns: usersColumns}
+
+	// A present bitmap with no columns set makes every row image empty.
+	data := append([]byte(nil), withoutChecksum(usersInsert)...)
+	data[eventHeaderSize+11] = 0
+
+	if _, err := c.parseEvent(data); err == nil {
+		t.Error("parseEvent succeeded, want error")
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	pos, err := ParsePosition("binlog.000003:1376")
+	if err != nil {
+		t.Fatalf("ParsePosition: %v", err)
+	}
+	if want := (Position{File: "binlog.000003", Pos: 1376}); pos != want {
+		t.Errorf("ParsePosition = %v, want %v", pos, want)
+	}
+	if pos.String() != "binlog.000003:1376" {
+		t.Errorf("String = %q", pos.String())
+	}
+
+	for _, s := range []string{"", "binlog.000003", ":4", "binlog.000003:x", "binlog.000003:-1"} {
+		if _, err := ParsePosition(s); err == nil {
+			t.Errorf("ParsePosition(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package binlog
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// MySQL column type codes as they appear in table map events.
+const (
+	typeDecimal    = 0
+	typeTiny       = 1
+	typeShort      = 2
+	typeLong       = 3
+	typeFloat      = 4
+	typeDouble     = 5
+	typeNull       = 6
+	typeTimestamp  = 7
+	typeLongLong   = 8
+	typeInt24      = 9
+	typeDate       = 10
+	typeTime       = 11
+	typeDateTime   = 12
+	typeYear       = 13
+	typeVarchar    = 15
+	typeBit        = 16
+	typeTimestamp2 = 17
+	typeDateTime2  = 18
+	typeTime2      = 19
+	typeJSON       = 245
+	typeNewDecimal = 246
+	typeEnum       = 247
+	typeSet        = 248
+	typeTinyBlob   = 249
+	typeMediumBlob = 250
+	typeLongBlob   = 251
+	typeBlob       = 252
+	typeVarString  = 253
+	typeString     = 254
+	typeGeometry   = 255
+)
+
+var errShortData = errors.New("unexpected end of event")
+
+// columnMeta reads the per-column metadata stored in a table map event.
+func columnMeta(t byte, r *reader) uint16 {
+	switch t {
+	case typeFloat, typeDouble, typeBlob, typeTinyBlob, typeMediumBlob, typeLongBlob,
+		typeGeometry, typeJSON, typeTimestamp2, typeDateTime2, typeTime2:
+		return uint16(r.byte())
+	case typeVarchar, typeVarString, typeBit:
+		return r.uint16()
+	case typeString, typeEnum, typeSet, typeNewDecimal:
+		// stored big-endian: real type / precision first
+		return uint16(r.uintBE(2))
+	default:
+		return 0
+	}
+}
+
+// rowImage decodes one row image. Columns not present in the image are
+// left nil.
+func (r *reader) rowImage(table *Table, present []byte) []any {
+	presentCount := 0
+	for i := range table.Columns {
+		if bitSet(present, i) {
+			presentCount++
+		}
+	}
+	nulls := r.bytes((presentCount + 7) / 8)
+
+	values := make([]any, len(table.Columns))
+	n := 0
+	for i, col := range table.Columns {
+		if !bitSet(present, i) {
+			continue
+		}
+		isNull := bitSet(nulls, n)
+		n++
+		if isNull {
+			continue
+		}
+		values[i] = r.value(col)
+		if r.err != nil {
+			return nil
+		}
+	}
+	return values
+}
+
+// value decodes a single column value. Types the cache does not need are
+// skipped over and returned as nil.
+func (r *reader) value(col Column) any {
+	switch col.Type {
+	case typeTiny:
+		return int64(int8(r.byte()))
+	case typeShort:
+		return int64(int16(r.uint16()))
+	case typeInt24:
+		v := r.uintN(3)
+		if v&0x800000 != 0 {
+			v |= 0xffffffffff000000
+		}
+		return int64(v)
+	case typeLong:
+		return int64(int32(r.uintN(4)))
+	case typeLongLong:
+		return int64(r.uintN(8))
+	case typeFloat:
+		return float64(math.Float32frombits(uint32(r.uintN(4))))
+	case typeDouble:
+		return math.Float64frombits(r.uintN(8))
+	case typeYear:
+		return int64(r.byte()) + 1900
+
+	case typeVarchar, typeVarString:
+		if col.Meta < 256 {
+			return string(r.bytes(int(r.byte())))
+		}
+		return string(r.bytes(int(r.uint16())))
+	case typeString:
+		realType, length := byte(col.Meta>>8), col.Meta&0xff
+		if realType == typeEnum || realType == typeSet {
+			return r.uintN(int(length))
+		}
+		// The top bits of the max length are folded into the type byte.
+		maxLen := int(((uint16(realType)&0x30)^0x30)<<4) | int(length)
+		if maxLen > 255 {
+			return string(r.bytes(int(r.uint16())))
+		}
+		return string(r.bytes(int(r.byte())))
+	case typeEnum, typeSet:
+		return r.uintN(int(col.Meta & 0xff))
+	case typeBlob, typeTinyBlob, typeMediumBlob, typeLongBlob, typeGeometry, typeJSON:
+		return r.bytes(int(r.uintN(int(col.Meta))))
+
+	case typeTimestamp:
+		return time.Unix(int64(r.uintN(4)), 0).UTC()
+	case typeTimestamp2:
+		sec := r.uintBE(4)
+		return time.Unix(int64(sec), fractional(r, col.Meta)*1000).UTC()
+	case typeDateTime2:
+		return datetime2(r, col.Meta)
+
+	case typeDate, typeTime:
+		r.skip(3)
+	case typeDateTime:
+		r.skip(8)
+	case typeTime2:
+		r.skip(3 + (int(col.Meta)+1)/2)
+	case typeBit:
+		r.skip(int(col.Meta>>8) + (int(col.Meta&0xff)+7)/8)
+	case typeNewDecimal:
+		precision, scale := int(col.Meta>>8), int(col.Meta&0xff)
+		if scale > precision {
+			r.fail(fmt.Errorf("invalid decimal(%d,%d)", precision, scale))
+			return nil
+		}
+		r.skip(decimalSize(precision, scale))
+	case typeNull:
+	default:
+		r.fail(fmt.Errorf("unsupported column type %d", col.Type))
+	}
+	return nil
+}
+
+// fractional reads the fractional-seconds part of a temporal value with
+// precision fsp and returns it in microseconds.
+func fractional(r *reader, fsp uint16) int64 {
+	n := (int(fsp) + 1) / 2
+	if n == 0 {
+		return 0
+	}
+	v := int64(r.uintBE(n))
+	for i := n * 2; i < 6; i++ {
+		v *= 10
+	}
+	return v
+}
+
+func datetime2(r *reader, fsp uint16) any {
+	packed := r.uintBE(5)
+	micros := fractional(r, fsp)
+
+	// 1 sign bit, 17 bits year*13+month, 5 day, 5 hour, 6 minute, 6 second
+	ym := packed >> 22 & (1<<17 - 1)
+	return time.Date(
+		int(ym/13), time.Month(ym%13),
+		int(packed>>17&0x1f), int(packed>>12&0x1f), int(packed>>6&0x3f), int(packed&0x3f),
+		int(micros)*1000, time.UTC,
+	)
+}
+
+func decimalSize(precision, scale int) int {
+	digitBytes := [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+	intg := precision - scale
+	return intg/9*4 + digitBytes[intg%9] + scale/9*4 + digitBytes[scale%9]
+}
+
+func bitSet(bitmap []byte, i int) bool {
+	return i/8 < len(bitmap) && bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// reader consumes little-endian protocol data. After the first error every
+// read returns zero values and err holds the cause.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *reader) remaining() int {
+	return len(r.data)
+}
+
+func (r *reader) bytes(n int) []byte {
+	if n < 0 || n > len(r.data) {
+		r.fail(errShortData)
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	return uint16(r.uintN(2))
+}
+
+func (r *reader) uint48() uint64 {
+	return r.uintN(6)
+}
+
+func (r *reader) uintN(n int) uint64 {
+	var v uint64
+	for i, b := range r.bytes(n) {
+		v |= uint64(b) << (8 * i)
+	}
+	return v
+}
+
+// uintBE reads an n-byte big-endian integer, the byte order of temporal
+// values and some table map metadata.
+func (r *reader) uintBE(n int) uint64 {
+	var v uint64
+	for _, b := range r.bytes(n) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// lenenc reads a length-encoded integer.
+func (r *reader) lenenc() uint64 {
+	switch first := r.byte(); {
+	case first < 0xfb:
+		return uint64(first)
+	case first == 0xfc:
+		return r.uintN(2)
+	case first == 0xfd:
+		return r.uintN(3)
+	case first == 0xfe:
+		return r.uintN(8)
+	default:
+		r.fail(fmt.Errorf("invalid length-encoded integer 0x%02x", first))
+		return 0
+	}
+}
@@ -0,0 +1,123 @@
+package binlog
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestValue(t *testing.T) {
+	tests := []struct {
+		name string
+		col  Column
+		data string
+		want any
+	}{
+		{"tiny", Column{Type: typeTiny}, "ff", int64(-1)},
+		{"short", Column{Type: typeShort}, "feff", int64(-2)},
+		{"int24", Column{Type: typeInt24}, "fdffff", int64(-3)},
+		{"long", Column{Type: typeLong}, "fcffffff", int64(-4)},
+		{"longlong", Column{Type: typeLongLong}, "0000000000010000", int64(1 << 40)},
+		{"float", Column{Type: typeFloat, Meta: 4}, "0000c03f", float64(1.5)},
+		{"double", Column{Type: typeDouble, Meta: 8}, "0000000000000240", float64(2.25)},
+		{"year", Column{Type: typeYear}, "7c", int64(2024)},
+		{"varchar with 1-byte length", Column{Type: typeVarchar, Meta: 80}, "03616263", "abc"},
+		{"varchar with 2-byte length", Column{Type: typeVarchar, Meta: 1020}, "0300616263", "abc"},
+		{"char", Column{Type: typeString, Meta: 0xfe28}, "026869", "hi"},
+		{"enum", Column{Type: typeString, Meta: 0xf701}, "02", uint64(2)},
+		{"blob", Column{Type: typeBlob, Meta: 2}, "030078797a", []byte("xyz")},
+		{"timestamp", Column{Type: typeTimestamp}, "00f15365", time.Unix(1700000000, 0).UTC()},
+		{"timestamp2", Column{Type: typeTimestamp2}, "6553f100", time.Unix(1700000000, 0).UTC()},
+		{"timestamp2 with millis", Column{Type: typeTimestamp2, Meta: 3}, "6553f10004d2", time.Unix(1700000000, 123400000).UTC()},
+		{"timestamp2 with micros", Column{Type: typeTimestamp2, Meta: 6}, "6553f10001e240", time.Unix(1700000000, 123456000).UTC()},
+		{"datetime2", Column{Type: typeDateTime2}, "99b2caa51e", time.Date(2024, 3, 5, 10, 20, 30, 0, time.UTC)},
+		{"date is skipped", Column{Type: typeDate}, "a5e80f", nil},
+		{"decimal is skipped", Column{Type: typeNewDecimal, Meta: 0x0a02}, "8000000001", nil},
+		{"null", Column{Type: typeNull}, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := mustHex(tt.data)
+
+			r := &reader{data: data}
+			got := r.value(tt.col)
+			if r.err != nil {
+				t.Fatalf("value: %v", r.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("value = %#v, want %#v", got, tt.want)
+			}
+			if r.remaining() != 0 {
+				t.Errorf("%d bytes left over", r.remaining())
+			}
+
+			for n := range len(data) {
+				r := &reader{data: data[:n]}
+				r.value(tt.col)
+				if !errors.Is(r.err, errShortData) {
+					t.Errorf("value of %d/%d bytes: err = %v, want %v", n, len(data), r.err, errShortData)
+				}
+			}
+		})
+	}
+}
+
+func TestValueInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		col  Column
+		data string
+	}{
+		{"unsupported type", Column{Type: 14}, "00"},
+		{"decimal scale above precision", Column{Type: typeNewDecimal, Meta: 0x0205}, "0000000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reader{data: mustHex(tt.data)}
+			if got := r.value(tt.col); got != nil {
+				t.Errorf("value = %#v, want nil", got)
+			}
+			if r.err == nil {
+				t.Error("value succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestLenenc(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+		err  bool
+	}{
+		{"fa", 250, false},
+		{"fc0001", 256, false},
+		{"fd000001", 1 << 16, false},
+		{"fe0000000001000000", 1 << 32, false},
+		{"fc00", 0, true},
+		{"ff", 0, true},
+	}
+
+	for _, tt := range tests {
+		r := &reader{data: mustHex(tt.data)}
+		got := r.lenenc()
+		if (r.err != nil) != tt.err {
+			t.Errorf("lenenc(%s) err = %v, want error %v", tt.data, r.err, tt.err)
+		}
+		if got != tt.want {
+			t.Errorf("lenenc(%s) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// Filter is an in-memory Bloom filter. Its bit layout matches Redis bitmaps
+// (bit 0 is the most significant bit of byte 0), so the bytes of a filter
+// built here can be stored with SET and probed with GETBIT/SETBIT.
+type Filter struct {
+	bits []byte
+	m    uint64
+	k    uint64
+}
+
+func New(m, k uint64) *Filter {
+	if m == 0 {
+		m = 1
+	}
+	if k == 0 {
+		k = 1
+	}
+	return &Filter{
+		bits: make([]byte, (m+7)/8),
+		m:    m,
+		k:    k,
+	}
+}
+
+// NewWithEstimates sizes a filter for n items at false positive rate p.
+func NewWithEstimates(n uint64, p float64) *Filter {
+	m, k := Estimate(n, p)
+	return New(m, k)
+}
+
+// Estimate returns the number of bits and hash functions needed to hold n
+// items at false positive rate p.
+func Estimate(n uint64, p float64) (m, k uint64) {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m = uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k = uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return m, k
+}
+
+func (f *Filter) Add(item string) {
+	for _, loc := range Locations(item, f.m, f.k) {
+		f.bits[loc/8] |= 0x80 >> (loc % 8)
+	}
+}
+
+func (f *Filter) Test(item string) bool {
+	for _, loc := range Locations(item, f.m, f.k) {
+		if f.bits[loc/8]&(0x80>>(loc%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) Bytes() []byte {
+	return f.bits
+}
+
+func (f *Filter) Bits() uint64 {
+	return f.m
+}
+
+func (f *Filter) Hashes() uint64 {
+	return f.k
+}
+
+// Locations returns the k bit offsets for item in a filter of m bits, using
+// double hashing over the two halves of a 128-bit FNV-1a digest.
+func Locations(item string, m, k uint64) []uint64 {
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	sum := h.Sum(nil)
+
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+
+	locs := make([]uint64, k)
+	for i := uint64(0); i < k; i++ {
+		locs[i] = (h1 + i*h2) % m
+	}
+	return locs
+}
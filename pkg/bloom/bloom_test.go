@@ -0,0 +1,49 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNoFalseNegatives(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+	for i := range 1000 {
+		f.Add(fmt.Sprintf("user%d@katakode.com", i))
+	}
+
+	for i := range 1000 {
+		if name := fmt.Sprintf("user%d@katakode.com", i); !f.Test(name) {
+			t.Fatalf("Test(%q) = false after Add", name)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	f := NewWithEstimates(1000, 0.01)
+	for i := range 1000 {
+		f.Add(fmt.Sprintf("user%d@katakode.com", i))
+	}
+
+	positives := 0
+	for i := range 10000 {
+		if f.Test(fmt.Sprintf("other%d@katakode.com", i)) {
+			positives++
+		}
+	}
+	if rate := float64(positives) / 10000; rate > 0.03 {
+		t.Errorf("false positive rate = %.4f, want about 0.01", rate)
+	}
+}
+
+// Redis GETBIT numbers bits from the most significant bit of each byte;
+// Bytes must match so the worker's filter can be probed in Redis.
+func TestBitLayoutMatchesRedis(t *testing.T) {
+	f := New(64, 3)
+	f.Add("test@katakode.com")
+
+	for _, loc := range Locations("test@katakode.com", f.Bits(), f.Hashes()) {
+		if f.Bytes()[loc/8]&(0x80>>(loc%8)) == 0 {
+			t.Errorf("bit %d is not set in Redis order", loc)
+		}
+	}
+}
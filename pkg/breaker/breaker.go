@@ -0,0 +1,163 @@
+package breaker
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrOpen is returned instead of running the call while the breaker is open.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Breaker opens after failureThreshold consecutive failures, where a call
+// slower than slowThreshold counts as a failure even if it succeeded. After
+// openTimeout it lets a single probe through (half-open); the probe's
+// outcome closes the breaker or opens it for another openTimeout.
+type Breaker struct {
+	name             string
+	failureThreshold int
+	slowThreshold    time.Duration
+	openTimeout      time.Duration
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	rejected  atomic.Int64
+	openCount atomic.Int64
+}
+
+func New(name string, failureThreshold int, slowThreshold, openTimeout time.Duration) *Breaker {
+	if failureThreshold <= 0 {
+		failureThreshold = 1
+	}
+	return &Breaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		slowThreshold:    slowThreshold,
+		openTimeout:      openTimeout,
+	}
+}
+
+// Do runs fn unless the breaker is open, recording its outcome.
+func (b *Breaker) Do(fn func() error) error {
+	if !b.allow() {
+		b.rejected.Add(1)
+		return ErrOpen
+	}
+
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	slow := b.slowThreshold > 0 && elapsed > b.slowThreshold
+	b.record(err == nil && !slow, err, elapsed)
+
+	return err
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Rejected is the number of calls short-circuited while open.
+func (b *Breaker) Rejected() int64 {
+	return b.rejected.Load()
+}
+
+// Opened is the number of times the breaker has opened.
+func (b *Breaker) Opened() int64 {
+	return b.openCount.Load()
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.transition(StateHalfOpen)
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		// Only one probe at a time while half-open.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) record(success bool, err error, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen {
+		b.probing = false
+		if success {
+			b.failures = 0
+			b.transition(StateClosed)
+		} else {
+			b.open(err, elapsed)
+		}
+		return
+	}
+
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == StateClosed && b.failures >= b.failureThreshold {
+		b.open(err, elapsed)
+	}
+}
+
+func (b *Breaker) open(err error, elapsed time.Duration) {
+	b.openedAt = time.Now()
+	b.openCount.Add(1)
+	slog.Warn("Circuit breaker tripped", "name", b.name, "failures", b.failures, "last_error", err, "last_latency", elapsed)
+	b.transition(StateOpen)
+}
+
+func (b *Breaker) transition(to State) {
+	if b.state == to {
+		return
+	}
+	slog.Info("Circuit breaker state changed", "name", b.name, "from", b.state, "to", to)
+	b.state = to
+}
@@ -0,0 +1,159 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errBackend = errors.New("backend down")
+
+func fail() error    { return errBackend }
+func succeed() error { return nil }
+
+func trip(t *testing.T, b *Breaker, failures int) {
+	t.Helper()
+
+	for range failures {
+		if err := b.Do(fail); !errors.Is(err, errBackend) {
+			t.Fatalf("Do = %v, want %v", err, errBackend)
+		}
+	}
+}
+
+func TestOpensAfterConsecutiveFailures(t *testing.T) {
+	b := New("test", 3, 0, time.Hour)
+
+	trip(t, b, 2)
+	if got := b.State(); got != StateClosed {
+		t.Fatalf("state after 2 failures = %v, want closed", got)
+	}
+
+	trip(t, b, 1)
+	if got := b.State(); got != StateOpen {
+		t.Fatalf("state after 3 failures = %v, want open", got)
+	}
+	if got := b.Opened(); got != 1 {
+		t.Errorf("Opened = %d, want 1", got)
+	}
+}
+
+func TestSuccessResetsFailureCount(t *testing.T) {
+	b := New("test", 3, 0, time.Hour)
+
+	trip(t, b, 2)
+	if err := b.Do(succeed); err != nil {
+		t.Fatalf("Do = %v", err)
+	}
+	trip(t, b, 2)
+
+	if got := b.State(); got != StateClosed {
+		t.Errorf("state = %v, want closed: failures were not consecutive", got)
+	}
+}
+
+func TestRejectsWhileOpen(t *testing.T) {
+	b := New("test", 1, 0, time.Hour)
+	trip(t, b, 1)
+
+	called := false
+	err := b.Do(func() error { called = true; return nil })
+	if !errors.Is(err, ErrOpen) {
+		t.Fatalf("Do = %v, want %v", err, ErrOpen)
+	}
+	if called {
+		t.Error("call ran while the breaker was open")
+	}
+	if got := b.Rejected(); got != 1 {
+		t.Errorf("Rejected = %d, want 1", got)
+	}
+}
+
+func TestHalfOpenProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe func() error
+		want  State
+	}{
+		{"successful probe closes", succeed, StateClosed},
+		{"failed probe reopens", fail, StateOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("test", 1, 0, 10*time.Millisecond)
+			trip(t, b, 1)
+			time.Sleep(20 * time.Millisecond)
+
+			b.Do(tt.probe)
+			if got := b.State(); got != tt.want {
+				t.Errorf("state after probe = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReopenedBreakerWaitsAgain(t *testing.T) {
+	b := New("test", 1, 0, 30*time.Millisecond)
+	trip(t, b, 1)
+	time.Sleep(40 * time.Millisecond)
+	b.Do(fail)
+
+	if err := b.Do(succeed); !errors.Is(err, ErrOpen) {
+		t.Errorf("Do right after a failed probe = %v, want %v", err, ErrOpen)
+	}
+	if got := b.Opened(); got != 2 {
+		t.Errorf("Opened = %d, want 2", got)
+	}
+}
+
+func TestSingleProbeWhileHalfOpen(t *testing.T) {
+	b := New("test", 1, 0, 10*time.Millisecond)
+	trip(t, b, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.Do(func() error {
+			close(probing)
+			<-release
+			return nil
+		})
+	}()
+
+	<-probing
+	if got := b.State(); got != StateHalfOpen {
+		t.Errorf("state during probe = %v, want half-open", got)
+	}
+	if err := b.Do(succeed); !errors.Is(err, ErrOpen) {
+		t.Errorf("second call during probe = %v, want %v", err, ErrOpen)
+	}
+
+	close(release)
+	wg.Wait()
+	if got := b.State(); got != StateClosed {
+		t.Errorf("state after probe = %v, want closed", got)
+	}
+}
+
+func TestSlowCallsCountAsFailures(t *testing.T) {
+	b := New("test", 2, 5*time.Millisecond, time.Hour)
+	slow := func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	for range 2 {
+		if err := b.Do(slow); err != nil {
+			t.Fatalf("Do = %v, want the call's own nil result", err)
+		}
+	}
+	if got := b.State(); got != StateOpen {
+		t.Errorf("state after 2 slow calls = %v, want open", got)
+	}
+}
@@ -0,0 +1,351 @@
+package codec
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/models"
+)
+
+// Codec converts cache entries to and from the value stored in Redis. Every
+// codec decodes every known format, so writers can switch formats while
+// readers are still running with a different setting.
+type Codec interface {
+	Name() string
+	Encode(entry *Entry) ([]byte, error)
+	Decode(data []byte) (*Entry, error)
+}
+
+// Entry is a cached user together with its freshness metadata. A zero
+// SoftExpiresAt (entries written before soft expiry existed) never goes
+// stale; such entries only disappear at their hard Redis expiry.
+type Entry struct {
+	User          *models.User
+	SoftExpiresAt time.Time
+}
+
+// Stale reports whether the entry is past its soft expiry at now.
+func (e *Entry) Stale(now time.Time) bool {
+	return !e.SoftExpiresAt.IsZero() && now.After(e.SoftExpiresAt)
+}
+
+// SampleSize returns the size c encodes a typical entry to: a seeded
+// username with a bcrypt hash. Startup checks compare it with Redis value
+// size limits; longer usernames make real values larger.
+func SampleSize(c Codec) (int, error) {
+	now := time.Now()
+	data, err := c.Encode(&Entry{
+		User: &models.User{
+			ID:           1_000_000,
+			Username:     "01000000@katakode.com",
+			PasswordHash: "$2a$10$" + strings.Repeat("x", 53),
+			CreatedAt:    now,
+		},
+		SoftExpiresAt: now,
+	})
+	return len(data), err
+}
+
+// The first byte of a cached value identifies its format. Legacy JSON
+// values always start with '{', which never collides with a version byte.
+const (
+	formatJSON     byte = '{'
+	formatBinaryV1 byte = 0x01
+	formatBinaryV2 byte = 0x02
+)
+
+var ErrUnknownFormat = errors.New("unknown cache value format")
+
+func New(cfg *config.Config) (Codec, error) {
+	var c Codec
+	switch cfg.Cache.Codec {
+	case "binary":
+		c = Binary{}
+	case "json":
+		c = JSON{}
+	default:
+		return nil, fmt.Errorf("unknown cache codec %q", cfg.Cache.Codec)
+	}
+
+	// Sign first so the tag travels inside the ciphertext when both are on.
+	if cfg.Features.CacheSigningEnabled {
+		secrets, err := parseSecrets(cfg.Cache.HMACSecrets)
+		if err != nil {
+			return nil, err
+		}
+
+		signed, err := NewSigned(c, cfg.Cache.HMACActiveSecret, secrets)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Cache signing enabled", "active_secret", cfg.Cache.HMACActiveSecret, "secrets", len(secrets))
+		c = signed
+	}
+
+	if cfg.Features.CacheEncryptionEnabled {
+		keys, err := loadKeys(cfg.Cache.EncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted, err := NewEncrypted(c, cfg.Cache.EncryptionActiveKey, keys)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Cache encryption enabled", "active_key", cfg.Cache.EncryptionActiveKey, "keys", len(keys))
+		c = encrypted
+	}
+
+	return c, nil
+}
+
+// Decode detects the format of data and decodes it.
+func Decode(data []byte) (*Entry, error) {
+	if len(data) == 0 {
+		return nil, ErrUnknownFormat
+	}
+
+	switch data[0] {
+	case formatJSON:
+		return decodeJSON(data)
+	case formatBinaryV1:
+		return decodeBinaryV1(data[1:])
+	case formatBinaryV2:
+		return decodeBinaryV2(data[1:])
+	case formatEncrypted:
+		return nil, fmt.Errorf("%w: encrypted value needs a keyring", ErrUnknownFormat)
+	case formatSigned:
+		return nil, fmt.Errorf("%w: signed value needs a secret", ErrUnknownFormat)
+	default:
+		return nil, fmt.Errorf("%w: version %d", ErrUnknownFormat, data[0])
+	}
+}
+
+// Envelope describes how c packaged data: the key or secret id of each
+// encryption and signing layer, outermost first, and the format of the
+// innermost value, such as "aes-gcm:k1/hmac:s1/binary-v2". Values written
+// with the same settings have the same envelope whatever user they hold, so
+// it tells whether rewriting a value would change more than its contents.
+func Envelope(c Codec, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", ErrUnknownFormat
+	}
+
+	switch c := c.(type) {
+	case *Encrypted:
+		if data[0] != formatEncrypted {
+			return Envelope(c.inner, data)
+		}
+		id, plaintext, err := c.open(data)
+		if err != nil {
+			return "", err
+		}
+		inner, err := Envelope(c.inner, plaintext)
+		return "aes-gcm:" + id + "/" + inner, err
+
+	case *Signed:
+		if data[0] != formatSigned {
+			return Envelope(c.inner, data)
+		}
+		if len(data) < 2 || len(data) < 2+int(data[1])+sha256.Size {
+			return "", errTruncated
+		}
+		idEnd := 2 + int(data[1])
+		inner, err := Envelope(c.inner, data[idEnd+sha256.Size:])
+		return "hmac:" + string(data[2:idEnd]) + "/" + inner, err
+	}
+
+	switch data[0] {
+	case formatJSON:
+		return "json", nil
+	case formatBinaryV1:
+		return "binary-v1", nil
+	case formatBinaryV2:
+		return "binary-v2", nil
+	case formatEncrypted:
+		return "aes-gcm", nil
+	case formatSigned:
+		return "hmac", nil
+	default:
+		return "", fmt.Errorf("%w: version %d", ErrUnknownFormat, data[0])
+	}
+}
+
+// JSON is the original format, kept so writers can be rolled back. The soft
+// expiry is an extra field that older readers ignore.
+type JSON struct{}
+
+type jsonEntry struct {
+	models.User
+	SoftExpiresAt *time.Time `json:"soft_expires_at,omitempty"`
+}
+
+func (JSON) Name() string {
+	return "json"
+}
+
+func (JSON) Encode(entry *Entry) ([]byte, error) {
+	value := jsonEntry{User: *entry.User}
+	if !entry.SoftExpiresAt.IsZero() {
+		value.SoftExpiresAt = &entry.SoftExpiresAt
+	}
+	return json.Marshal(value)
+}
+
+func (JSON) Decode(data []byte) (*Entry, error) {
+	return Decode(data)
+}
+
+func decodeJSON(data []byte) (*Entry, error) {
+	var value jsonEntry
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{User: &value.User}
+	if value.SoftExpiresAt != nil {
+		entry.SoftExpiresAt = *value.SoftExpiresAt
+	}
+	return entry, nil
+}
+
+// Binary is a compact length-prefixed layout. Version 2 (written today):
+//
+//	version(1) | soft_expires_at unix seconds(varint) | id(uvarint) |
+//	created_at unix nanos(varint) | len(uvarint) username |
+//	len(uvarint) password_hash
+//
+// Version 1 is the same without soft_expires_at and is still decoded.
+type Binary struct{}
+
+func (Binary) Name() string {
+	return "binary"
+}
+
+func (Binary) Encode(entry *Entry) ([]byte, error) {
+	user := entry.User
+
+	var softExpiresAt int64
+	if !entry.SoftExpiresAt.IsZero() {
+		softExpiresAt = entry.SoftExpiresAt.Unix()
+	}
+
+	buf := make([]byte, 0, 1+4*binary.MaxVarintLen64+len(user.Username)+len(user.PasswordHash))
+	buf = append(buf, formatBinaryV2)
+	buf = binary.AppendVarint(buf, softExpiresAt)
+	buf = appendUser(buf, user)
+	return buf, nil
+}
+
+func (Binary) Decode(data []byte) (*Entry, error) {
+	return Decode(data)
+}
+
+func appendUser(buf []byte, user *models.User) []byte {
+	buf = binary.AppendUvarint(buf, uint64(user.ID))
+	buf = binary.AppendVarint(buf, user.CreatedAt.UnixNano())
+	buf = appendString(buf, user.Username)
+	buf = appendString(buf, user.PasswordHash)
+	return buf
+}
+
+func decodeBinaryV1(data []byte) (*Entry, error) {
+	r := reader{data: data}
+
+	user := r.user()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &Entry{User: user}, nil
+}
+
+func decodeBinaryV2(data []byte) (*Entry, error) {
+	r := reader{data: data}
+
+	softExpiresAt := r.varint()
+	user := r.user()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	entry := &Entry{User: user}
+	if softExpiresAt != 0 {
+		entry.SoftExpiresAt = time.Unix(softExpiresAt, 0).UTC()
+	}
+	return entry, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+var errTruncated = errors.New("truncated cache value")
+
+// reader walks a binary value, recording the first error so callers can
+// check once after reading every field.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) user() *models.User {
+	id := r.uvarint()
+	createdAt := r.varint()
+	username := r.string()
+	passwordHash := r.string()
+
+	return &models.User{
+		ID:           int64(id),
+		Username:     username,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Unix(0, createdAt).UTC(),
+	}
+}
+
+func (r *reader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errTruncated
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/models"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		User: &models.User{
+			ID:           42,
+			Username:     "test@katakode.com",
+			PasswordHash: "$2a$10$abcdefghijklmnopqrstuv",
+			CreatedAt:    time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC),
+		},
+		SoftExpiresAt: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC),
+	}
+}
+
+func assertEntry(t *testing.T, got, want *Entry) {
+	t.Helper()
+
+	if got.User.ID != want.User.ID || got.User.Username != want.User.Username ||
+		got.User.PasswordHash != want.User.PasswordHash || !got.User.CreatedAt.Equal(want.User.CreatedAt) {
+		t.Errorf("user = %+v, want %+v", got.User, want.User)
+	}
+	if !got.SoftExpiresAt.Equal(want.SoftExpiresAt) {
+		t.Errorf("soft expiry = %v, want %v", got.SoftExpiresAt, want.SoftExpiresAt)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	codecs := []Codec{JSON{}, Binary{}}
+
+	for _, writer := range codecs {
+		for _, reader := range codecs {
+			t.Run(writer.Name()+"->"+reader.Name(), func(t *testing.T) {
+				data, err := writer.Encode(testEntry())
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+
+				got, err := reader.Decode(data)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				assertEntry(t, got, testEntry())
+			})
+		}
+	}
+}
+
+func TestRoundTripWithoutSoftExpiry(t *testing.T) {
+	for _, c := range []Codec{JSON{}, Binary{}} {
+		t.Run(c.Name(), func(t *testing.T) {
+			entry := testEntry()
+			entry.SoftExpiresAt = time.Time{}
+
+			data, err := c.Encode(entry)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			got, err := c.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !got.SoftExpiresAt.IsZero() || got.Stale(time.Now()) {
+				t.Errorf("entry without soft expiry decoded with %v", got.SoftExpiresAt)
+			}
+		})
+	}
+}
+
+func TestDecodeBinaryV1(t *testing.T) {
+	entry := testEntry()
+	data := appendUser([]byte{formatBinaryV1}, entry.User)
+
+	got, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	entry.SoftExpiresAt = time.Time{}
+	assertEntry(t, got, entry)
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	valid, err := Binary{}.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrUnknownFormat},
+		{"unknown version", []byte{0x7f, 1, 2, 3}, ErrUnknownFormat},
+		{"encrypted without keyring", []byte{formatEncrypted, 0}, ErrUnknownFormat},
+		{"signed without secret", []byte{formatSigned, 0}, ErrUnknownFormat},
+		{"truncated binary", valid[:len(valid)-5], errTruncated},
+		{"version byte only", []byte{formatBinaryV2}, errTruncated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("Decode error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	entry := testEntry()
+
+	if entry.Stale(entry.SoftExpiresAt.Add(-time.Second)) {
+		t.Error("entry stale before its soft expiry")
+	}
+	if !entry.Stale(entry.SoftExpiresAt.Add(time.Second)) {
+		t.Error("entry not stale after its soft expiry")
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	secrets := map[string][]byte{"s1": []byte("first-secret"), "s2": []byte("second-secret")}
+	signed := newTestSigned(t, "s1", secrets)
+	rotated := newTestSigned(t, "s2", secrets)
+	encrypted := newTestEncryptedOver(t, signed)
+
+	jsonValue, _ := JSON{}.Encode(testEntry())
+	binaryValue, _ := Binary{}.Encode(testEntry())
+	signedValue, _ := signed.Encode(testEntry())
+	rotatedValue, _ := rotated.Encode(testEntry())
+	encryptedValue, _ := encrypted.Encode(testEntry())
+
+	tests := []struct {
+		name  string
+		codec Codec
+		data  []byte
+		want  string
+	}{
+		{"json", JSON{}, jsonValue, "json"},
+		{"binary", Binary{}, binaryValue, "binary-v2"},
+		{"binary v1", Binary{}, []byte{formatBinaryV1}, "binary-v1"},
+		{"signed", signed, signedValue, "hmac:s1/json"},
+		{"rotated secret", signed, rotatedValue, "hmac:s2/json"},
+		{"unsigned under a signing codec", signed, jsonValue, "json"},
+		{"signed then encrypted", encrypted, encryptedValue, "aes-gcm:k1/hmac:s1/json"},
+		{"not yet encrypted", encrypted, signedValue, "hmac:s1/json"},
+		{"encrypted without a keyring", JSON{}, encryptedValue, "aes-gcm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Envelope(tt.codec, tt.data)
+			if err != nil {
+				t.Fatalf("Envelope: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Envelope = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Envelope(JSON{}, nil); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Envelope of an empty value err = %v, want %v", err, ErrUnknownFormat)
+	}
+}
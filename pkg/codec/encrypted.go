@@ -0,0 +1,161 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// formatEncrypted marks a value sealed with AES-256-GCM:
+//
+//	version(1) | len(1) key id | nonce(12) | ciphertext+tag
+//
+// The header is authenticated as additional data. The plaintext is the
+// value produced by the inner codec, so any inner format can be encrypted.
+const formatEncrypted byte = 0x10
+
+var ErrUnknownKey = errors.New("cache value encrypted with unknown key")
+
+// Encrypted seals values produced by inner with the active key and opens
+// values sealed with any key in the keyring, so keys can be rotated by
+// adding a new active key and removing the old one once the cache has been
+// refreshed. Unencrypted values are still accepted so encryption can be
+// switched on without flushing the cache.
+type Encrypted struct {
+	inner    Codec
+	activeID string
+	keys     map[string]cipher.AEAD
+}
+
+func NewEncrypted(inner Codec, activeID string, keys map[string][]byte) (*Encrypted, error) {
+	if len(activeID) == 0 || len(activeID) > 255 {
+		return nil, fmt.Errorf("invalid active key id %q", activeID)
+	}
+
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache key %q: %w", id, err)
+		}
+		aeads[id] = aead
+	}
+
+	if _, ok := aeads[activeID]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", activeID)
+	}
+
+	return &Encrypted{inner: inner, activeID: activeID, keys: aeads}, nil
+}
+
+func (e *Encrypted) Name() string {
+	return e.inner.Name() + "+aes-gcm"
+}
+
+func (e *Encrypted) Encode(entry *Entry) ([]byte, error) {
+	plaintext, err := e.inner.Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	aead := e.keys[e.activeID]
+
+	header := make([]byte, 0, 2+len(e.activeID))
+	header = append(header, formatEncrypted, byte(len(e.activeID)))
+	header = append(header, e.activeID...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+func (e *Encrypted) Decode(data []byte) (*Entry, error) {
+	if len(data) == 0 || data[0] != formatEncrypted {
+		return e.inner.Decode(data)
+	}
+
+	_, plaintext, err := e.open(data)
+	if err != nil {
+		return nil, err
+	}
+	return e.inner.Decode(plaintext)
+}
+
+// open decrypts a sealed value and returns the id of the key it was sealed
+// with and the inner codec's value.
+func (e *Encrypted) open(data []byte) (string, []byte, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return "", nil, errTruncated
+	}
+	headerLen := 2 + int(data[1])
+	header, rest := data[:headerLen], data[headerLen:]
+
+	id := string(header[2:])
+	aead, ok := e.keys[id]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return "", nil, errTruncated
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: failed to decrypt: %v", ErrIntegrity, err)
+	}
+	return id, plaintext, nil
+}
+
+// loadKeys reads "id:path" pairs. Each file holds a base64-encoded 32-byte
+// key, e.g. generated with `openssl rand -base64 32`.
+func loadKeys(specs []string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(specs))
+	for _, spec := range specs {
+		id, path, ok := strings.Cut(spec, ":")
+		if !ok || id == "" || path == "" {
+			return nil, fmt.Errorf("invalid key spec %q, want id:path", spec)
+		}
+
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %q: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+func loadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %w", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
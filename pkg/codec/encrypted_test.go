@@ -0,0 +1,150 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func newTestEncrypted(t *testing.T, active string, keys map[string][]byte) *Encrypted {
+	t.Helper()
+
+	e, err := NewEncrypted(Binary{}, active, keys)
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	return e
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e := newTestEncrypted(t, "k1", map[string][]byte{"k1": testKey(1)})
+
+	data, err := e.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if data[0] != formatEncrypted {
+		t.Fatalf("format byte = %#x, want %#x", data[0], formatEncrypted)
+	}
+	if bytes.Contains(data, []byte(testEntry().User.Username)) {
+		t.Error("ciphertext contains the plaintext username")
+	}
+
+	got, err := e.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	assertEntry(t, got, testEntry())
+}
+
+func TestEncryptedUsesFreshNonces(t *testing.T) {
+	e := newTestEncrypted(t, "k1", map[string][]byte{"k1": testKey(1)})
+
+	a, _ := e.Encode(testEntry())
+	b, _ := e.Encode(testEntry())
+	if bytes.Equal(a, b) {
+		t.Error("two encodings of the same entry are identical")
+	}
+}
+
+func TestEncryptedTamper(t *testing.T) {
+	e := newTestEncrypted(t, "k1", map[string][]byte{"k1": testKey(1)})
+
+	data, err := e.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	headerLen := 2 + len("k1")
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+		want   error
+	}{
+		{"flipped ciphertext bit", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, ErrIntegrity},
+		{"flipped nonce bit", func(b []byte) []byte { b[headerLen] ^= 1; return b }, ErrIntegrity},
+		{"renamed key id", func(b []byte) []byte { b[3] = 'X'; return b }, ErrUnknownKey},
+		{"truncated nonce", func(b []byte) []byte { return b[:headerLen+4] }, errTruncated},
+		{"truncated header", func(b []byte) []byte { return b[:2] }, errTruncated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.mutate(bytes.Clone(data))
+			if _, err := e.Decode(tampered); !errors.Is(err, tt.want) {
+				t.Errorf("Decode error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	old := newTestEncrypted(t, "k1", map[string][]byte{"k1": testKey(1)})
+	sealedWithOld, err := old.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// Step 1: a new active key, the old one still in the keyring.
+	rotating := newTestEncrypted(t, "k2", map[string][]byte{"k1": testKey(1), "k2": testKey(2)})
+	got, err := rotating.Decode(sealedWithOld)
+	if err != nil {
+		t.Fatalf("Decode of old value during rotation: %v", err)
+	}
+	assertEntry(t, got, testEntry())
+
+	sealedWithNew, err := rotating.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if string(sealedWithNew[2:4]) != "k2" {
+		t.Errorf("new value sealed with key %q, want k2", sealedWithNew[2:4])
+	}
+
+	// Step 2: the old key is retired.
+	rotated := newTestEncrypted(t, "k2", map[string][]byte{"k2": testKey(2)})
+	if _, err := rotated.Decode(sealedWithNew); err != nil {
+		t.Errorf("Decode of new value after rotation: %v", err)
+	}
+	if _, err := rotated.Decode(sealedWithOld); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decode of old value after rotation = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestEncryptedAcceptsPlaintext(t *testing.T) {
+	e := newTestEncrypted(t, "k1", map[string][]byte{"k1": testKey(1)})
+
+	plain, err := JSON{}.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := e.Decode(plain)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	assertEntry(t, got, testEntry())
+}
+
+func TestNewEncryptedValidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		active string
+		keys   map[string][]byte
+	}{
+		{"empty active id", "", map[string][]byte{"k1": testKey(1)}},
+		{"active key missing", "k2", map[string][]byte{"k1": testKey(1)}},
+		{"short key", "k1", map[string][]byte{"k1": testKey(1)[:7]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewEncrypted(Binary{}, tt.active, tt.keys); err == nil {
+				t.Error("NewEncrypted succeeded, want error")
+			}
+		})
+	}
+}
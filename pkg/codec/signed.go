@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"substack-auth/pkg/models"
+)
+
+// formatSigned marks a value carrying an HMAC-SHA256 tag:
+//
+//	version(1) | len(1) secret id | tag(32) | inner value
+//
+// The tag covers the user's id, username and password hash, the fields an
+// attacker would need to forge to log in as someone else.
+const formatSigned byte = 0x20
+
+// ErrIntegrity is returned when a cache value fails authentication. Callers
+// should treat it as a miss, evict the value and record a security event.
+var ErrIntegrity = errors.New("cache value failed integrity check")
+
+// ErrUnsigned is returned for values written without a tag, typically before
+// signing was switched on. They are not trusted but are not evidence of
+// tampering either, so callers treat them as a plain miss.
+var ErrUnsigned = errors.New("cache value is not signed")
+
+// Signed tags values produced by inner with the active secret and verifies
+// them with any secret in the set, so secrets rotate like encryption keys.
+// Unsigned values are rejected: accepting them would let anyone with write
+// access to Redis bypass the check by omitting the tag.
+type Signed struct {
+	inner    Codec
+	activeID string
+	secrets  map[string][]byte
+}
+
+func NewSigned(inner Codec, activeID string, secrets map[string][]byte) (*Signed, error) {
+	if len(activeID) == 0 || len(activeID) > 255 {
+		return nil, fmt.Errorf("invalid active secret id %q", activeID)
+	}
+	if len(secrets[activeID]) == 0 {
+		return nil, fmt.Errorf("active secret %q is not configured", activeID)
+	}
+
+	return &Signed{inner: inner, activeID: activeID, secrets: secrets}, nil
+}
+
+func (s *Signed) Name() string {
+	return s.inner.Name() + "+hmac"
+}
+
+func (s *Signed) Encode(entry *Entry) ([]byte, error) {
+	value, err := s.inner.Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := sign(s.secrets[s.activeID], entry.User)
+
+	out := make([]byte, 0, 2+len(s.activeID)+len(tag)+len(value))
+	out = append(out, formatSigned, byte(len(s.activeID)))
+	out = append(out, s.activeID...)
+	out = append(out, tag...)
+	return append(out, value...), nil
+}
+
+func (s *Signed) Decode(data []byte) (*Entry, error) {
+	if len(data) == 0 || data[0] != formatSigned {
+		return nil, ErrUnsigned
+	}
+
+	if len(data) < 2 || len(data) < 2+int(data[1])+sha256.Size {
+		return nil, fmt.Errorf("%w: %v", ErrIntegrity, errTruncated)
+	}
+	idEnd := 2 + int(data[1])
+	id := string(data[2:idEnd])
+	tag := data[idEnd : idEnd+sha256.Size]
+
+	secret, ok := s.secrets[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown secret %q", ErrIntegrity, id)
+	}
+
+	entry, err := s.inner.Decode(data[idEnd+sha256.Size:])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(tag, sign(secret, entry.User)) {
+		return nil, fmt.Errorf("%w: tag mismatch", ErrIntegrity)
+	}
+
+	return entry, nil
+}
+
+func sign(secret []byte, user *models.User) []byte {
+	mac := hmac.New(sha256.New, secret)
+
+	var buf [binary.MaxVarintLen64]byte
+	mac.Write(buf[:binary.PutUvarint(buf[:], uint64(user.ID))])
+	for _, field := range []string{user.Username, user.PasswordHash} {
+		mac.Write(buf[:binary.PutUvarint(buf[:], uint64(len(field)))])
+		mac.Write([]byte(field))
+	}
+
+	return mac.Sum(nil)
+}
+
+// minSecretLen is the shortest HMAC secret accepted, matching the SHA-256
+// block of key material an attacker would have to guess.
+const minSecretLen = 32
+
+// placeholderSecret is the example value once shipped in env.example; it is
+// public and must never sign anything.
+const placeholderSecret = "change-me-to-a-long-random-string"
+
+// parseSecrets reads "id:secret" pairs.
+func parseSecrets(specs []string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte, len(specs))
+	for i, spec := range specs {
+		// Never echo the spec: without a colon it is the secret itself.
+		id, secret, ok := strings.Cut(spec, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid secret spec #%d, want id:secret", i+1)
+		}
+		if secret == placeholderSecret {
+			return nil, fmt.Errorf("secret %q is the example placeholder; generate a random one", id)
+		}
+		if len(secret) < minSecretLen {
+			return nil, fmt.Errorf("secret %q is %d bytes, want at least %d", id, len(secret), minSecretLen)
+		}
+		secrets[id] = []byte(secret)
+	}
+	return secrets, nil
+}
@@ -0,0 +1,167 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestSigned(t *testing.T, active string, secrets map[string][]byte) *Signed {
+	t.Helper()
+
+	s, err := NewSigned(JSON{}, active, secrets)
+	if err != nil {
+		t.Fatalf("NewSigned: %v", err)
+	}
+	return s
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	s := newTestSigned(t, "s1", map[string][]byte{"s1": []byte("first-secret")})
+
+	data, err := s.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := s.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	assertEntry(t, got, testEntry())
+}
+
+func TestSignedTamper(t *testing.T) {
+	s := newTestSigned(t, "s1", map[string][]byte{"s1": []byte("first-secret")})
+
+	data, err := s.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	user := testEntry().User
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+		want   error
+	}{
+		{"swapped password hash", func(b []byte) []byte {
+			return bytes.Replace(b, []byte(user.PasswordHash), []byte("$2a$10$attackerchosenhashvalue"), 1)
+		}, ErrIntegrity},
+		{"swapped username", func(b []byte) []byte {
+			return bytes.Replace(b, []byte(user.Username), []byte("evil@katakode.com"), 1)
+		}, ErrIntegrity},
+		{"flipped tag bit", func(b []byte) []byte { b[2+len("s1")] ^= 1; return b }, ErrIntegrity},
+		{"unknown secret id", func(b []byte) []byte { b[3] = 'X'; return b }, ErrIntegrity},
+		{"truncated tag", func(b []byte) []byte { return b[:10] }, ErrIntegrity},
+		{"tag stripped", func(b []byte) []byte { return b[2+len("s1")+32:] }, ErrUnsigned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.mutate(bytes.Clone(data))
+			if _, err := s.Decode(tampered); !errors.Is(err, tt.want) {
+				t.Errorf("Decode error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedRejectsUnsigned(t *testing.T) {
+	s := newTestSigned(t, "s1", map[string][]byte{"s1": []byte("first-secret")})
+
+	for _, c := range []Codec{JSON{}, Binary{}} {
+		data, err := c.Encode(testEntry())
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if _, err := s.Decode(data); !errors.Is(err, ErrUnsigned) {
+			t.Errorf("%s value: Decode error = %v, want %v", c.Name(), err, ErrUnsigned)
+		}
+	}
+}
+
+func TestSignedSecretRotation(t *testing.T) {
+	old := newTestSigned(t, "s1", map[string][]byte{"s1": []byte("first-secret")})
+	signedWithOld, err := old.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	rotating := newTestSigned(t, "s2", map[string][]byte{"s1": []byte("first-secret"), "s2": []byte("second-secret")})
+	if _, err := rotating.Decode(signedWithOld); err != nil {
+		t.Fatalf("Decode of old value during rotation: %v", err)
+	}
+	signedWithNew, err := rotating.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	rotated := newTestSigned(t, "s2", map[string][]byte{"s2": []byte("second-secret")})
+	if _, err := rotated.Decode(signedWithNew); err != nil {
+		t.Errorf("Decode of new value after rotation: %v", err)
+	}
+	if _, err := rotated.Decode(signedWithOld); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Decode of old value after rotation = %v, want %v", err, ErrIntegrity)
+	}
+}
+
+func TestSignedThenEncrypted(t *testing.T) {
+	s := newTestSigned(t, "s1", map[string][]byte{"s1": []byte("first-secret")})
+	e := newTestEncryptedOver(t, s)
+
+	data, err := e.Encode(testEntry())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got, err := e.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	assertEntry(t, got, testEntry())
+
+	// An attacker who can write Redis but lacks the key cannot fall back to
+	// an unencrypted, unsigned value.
+	plain, _ := JSON{}.Encode(testEntry())
+	if _, err := e.Decode(plain); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Decode of plaintext value = %v, want %v", err, ErrUnsigned)
+	}
+}
+
+func newTestEncryptedOver(t *testing.T, inner Codec) *Encrypted {
+	t.Helper()
+
+	e, err := NewEncrypted(inner, "k1", map[string][]byte{"k1": testKey(1)})
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	return e
+}
+
+func TestParseSecrets(t *testing.T) {
+	strong := "k1:" + strings.Repeat("s", minSecretLen)
+
+	tests := []struct {
+		name    string
+		specs   []string
+		wantErr bool
+	}{
+		{"valid", []string{strong}, false},
+		{"missing colon", []string{strings.Repeat("s", minSecretLen)}, true},
+		{"empty id", []string{":" + strings.Repeat("s", minSecretLen)}, true},
+		{"short secret", []string{"k1:short"}, true},
+		{"example placeholder", []string{"k1:" + placeholderSecret}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSecrets(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecrets error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), strings.Repeat("s", minSecretLen)) {
+				t.Errorf("error %q leaks the secret", err)
+			}
+		})
+	}
+}
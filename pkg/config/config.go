@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -18,12 +19,29 @@ type Config struct {
 		Name     string
 	}
 	Redis struct {
-		Host     string
-		Port     int
-		Password string
-		DB       int
-		Prefix   string
-		TTL      string
+		Mode             string
+		Host             string
+		Port             int
+		Addrs            []string
+		MasterName       string
+		Password         string
+		SentinelPassword string
+		DB               int
+		Prefix           string
+		TTL              string
+		SoftTTL          string
+		TTLJitter        string
+		Layout           string
+		Buckets          int
+		KeyHashing       bool
+		KeyHashSecret    string
+	}
+	Cache struct {
+		Codec               string
+		EncryptionKeys      []string
+		EncryptionActiveKey string
+		HMACSecrets         []string
+		HMACActiveSecret    string
 	}
 	JWT struct {
 		PrivateKeyPath string
@@ -31,19 +49,71 @@ type Config struct {
 		Expiration     time.Duration
 	}
 	Features struct {
-		CacheEnabled    bool
-		PrecacheEnabled bool
+		CacheEnabled            bool
+		L1CacheEnabled          bool
+		PrecacheEnabled         bool
+		BloomFilterEnabled      bool
+		FillLockEnabled         bool
+		CircuitBreakerEnabled   bool
+		CacheEncryptionEnabled  bool
+		CacheSigningEnabled     bool
+		LeaderElectionEnabled   bool
+		ActivityTrackingEnabled bool
+		RefreshQueueEnabled     bool
+	}
+	L1Cache struct {
+		Size int
+		TTL  time.Duration
+	}
+	FillLock struct {
+		TTL time.Duration
+	}
+	RefreshQueue struct {
+		MaxLength    int
+		PollInterval time.Duration
+	}
+	CircuitBreaker struct {
+		FailureThreshold  int
+		SlowCallThreshold time.Duration
+		OpenTimeout       time.Duration
+	}
+	Bloom struct {
+		ExpectedItems     int
+		FalsePositiveRate float64
 	}
 	Precache struct {
-		BatchSize    int
-		CronSchedule string
+		BatchSize         int
+		Writers           int
+		EvictDeleted      bool
+		CheckpointTTL     time.Duration
+		MemoryBudget      float64
+		MemoryPolicy      string
+		HotSetSize        int
+		HotSetWindow      time.Duration
+		ActivityRetention time.Duration
+		CronSchedule      string
+		OverlapPolicy     string
+		HistorySize       int
+		Mode              string
+		FullSweepInterval time.Duration
+		WatermarkOverlap  time.Duration
+	}
+	CDC struct {
+		ServerID int
+	}
+	Leader struct {
+		InstanceID string
+		LeaseTTL   time.Duration
 	}
 	Log struct {
 		Level string
 	}
 	Service struct {
-		AuthBasicPort    int
-		AuthImprovedPort int
+		AuthBasicPort      int
+		AuthImprovedPort   int
+		PrecacheAdminHost  string
+		PrecacheAdminPort  int
+		PrecacheAdminToken string
 	}
 }
 
@@ -77,27 +147,88 @@ func Load() *Config {
 	cfg.DB.Password = getEnv("DB_PASSWORD", "root")
 	cfg.DB.Name = getEnv("DB_NAME", "auth")
 
+	cfg.Redis.Mode = getEnv("REDIS_MODE", "standalone")
 	cfg.Redis.Host = getEnv("REDIS_HOST", "localhost")
 	cfg.Redis.Port = getEnvAsInt("REDIS_PORT", 6379)
+	cfg.Redis.Addrs = getEnvAsSlice("REDIS_ADDRS", nil)
+	cfg.Redis.MasterName = getEnv("REDIS_MASTER_NAME", "")
 	cfg.Redis.Password = getEnv("REDIS_PASSWORD", "")
+	cfg.Redis.SentinelPassword = getEnv("REDIS_SENTINEL_PASSWORD", "")
 	cfg.Redis.DB = getEnvAsInt("REDIS_DB", 0)
 	cfg.Redis.Prefix = getEnv("REDIS_PREFIX", "auth:")
 	cfg.Redis.TTL = getEnv("REDIS_TTL", "1h")
+	cfg.Redis.SoftTTL = getEnv("REDIS_SOFT_TTL", "0")
+	cfg.Redis.TTLJitter = getEnv("REDIS_TTL_JITTER", "5m")
+	cfg.Redis.Layout = getEnv("REDIS_LAYOUT", "string")
+	cfg.Redis.Buckets = getEnvAsInt("REDIS_BUCKETS", 16384)
+	cfg.Redis.KeyHashing = getEnvAsBool("REDIS_KEY_HASHING", false)
+	cfg.Redis.KeyHashSecret = getEnv("REDIS_KEY_HASH_SECRET", "")
+
+	cfg.Cache.Codec = getEnv("CACHE_CODEC", "json")
+	cfg.Cache.EncryptionKeys = getEnvAsSlice("CACHE_ENCRYPTION_KEYS", []string{"k1:./keys/cache.key"})
+	cfg.Cache.EncryptionActiveKey = getEnv("CACHE_ENCRYPTION_ACTIVE_KEY", "k1")
+	cfg.Cache.HMACSecrets = getEnvAsSlice("CACHE_HMAC_SECRETS", nil)
+	cfg.Cache.HMACActiveSecret = getEnv("CACHE_HMAC_ACTIVE_SECRET", "k1")
 
 	cfg.JWT.PrivateKeyPath = getEnv("JWT_PRIVATE_KEY_PATH", "./keys/private.pem")
 	cfg.JWT.PublicKeyPath = getEnv("JWT_PUBLIC_KEY_PATH", "./keys/public.pem")
 	cfg.JWT.Expiration = getEnvAsDuration("JWT_EXPIRATION", time.Hour)
 
 	cfg.Features.CacheEnabled = getEnvAsBool("CACHE_ENABLED", true)
+	cfg.Features.L1CacheEnabled = getEnvAsBool("L1_CACHE_ENABLED", false)
 	cfg.Features.PrecacheEnabled = getEnvAsBool("PRECACHE_ENABLED", true)
+	cfg.Features.BloomFilterEnabled = getEnvAsBool("BLOOM_FILTER_ENABLED", false)
+	cfg.Features.FillLockEnabled = getEnvAsBool("FILL_LOCK_ENABLED", false)
+	cfg.Features.CircuitBreakerEnabled = getEnvAsBool("CIRCUIT_BREAKER_ENABLED", false)
+	cfg.Features.CacheEncryptionEnabled = getEnvAsBool("CACHE_ENCRYPTION_ENABLED", false)
+	cfg.Features.CacheSigningEnabled = getEnvAsBool("CACHE_SIGNING_ENABLED", false)
+	cfg.Features.LeaderElectionEnabled = getEnvAsBool("LEADER_ELECTION_ENABLED", false)
+	cfg.Features.ActivityTrackingEnabled = getEnvAsBool("ACTIVITY_TRACKING_ENABLED", false)
+	cfg.Features.RefreshQueueEnabled = getEnvAsBool("REFRESH_QUEUE_ENABLED", false)
+
+	cfg.L1Cache.Size = getEnvAsInt("L1_CACHE_SIZE", 100000)
+	cfg.L1Cache.TTL = getEnvAsDuration("L1_CACHE_TTL", 30*time.Second)
+
+	cfg.FillLock.TTL = getEnvAsDuration("FILL_LOCK_TTL", 2*time.Second)
+
+	cfg.RefreshQueue.MaxLength = getEnvAsInt("REFRESH_QUEUE_MAX_LENGTH", 10000)
+	cfg.RefreshQueue.PollInterval = getEnvAsDuration("REFRESH_QUEUE_POLL_INTERVAL", 100*time.Millisecond)
+
+	cfg.CircuitBreaker.FailureThreshold = getEnvAsInt("CIRCUIT_BREAKER_FAILURE_THRESHOLD", 5)
+	cfg.CircuitBreaker.SlowCallThreshold = getEnvAsDuration("CIRCUIT_BREAKER_SLOW_CALL_THRESHOLD", 100*time.Millisecond)
+	cfg.CircuitBreaker.OpenTimeout = getEnvAsDuration("CIRCUIT_BREAKER_OPEN_TIMEOUT", 10*time.Second)
+
+	cfg.Bloom.ExpectedItems = getEnvAsInt("BLOOM_EXPECTED_ITEMS", 1000000)
+	cfg.Bloom.FalsePositiveRate = getEnvAsFloat("BLOOM_FALSE_POSITIVE_RATE", 0.01)
 
 	cfg.Precache.BatchSize = getEnvAsInt("BATCH_SIZE", 10000)
+	cfg.Precache.Writers = getEnvAsInt("PRECACHE_WRITERS", 4)
+	cfg.Precache.EvictDeleted = getEnvAsBool("PRECACHE_EVICT_DELETED", true)
+	cfg.Precache.CheckpointTTL = getEnvAsDuration("PRECACHE_CHECKPOINT_TTL", 30*time.Minute)
+	cfg.Precache.MemoryBudget = getEnvAsFloat("PRECACHE_MEMORY_BUDGET", 0.9)
+	cfg.Precache.MemoryPolicy = getEnv("PRECACHE_MEMORY_POLICY", "existing")
+	cfg.Precache.HotSetSize = getEnvAsInt("PRECACHE_HOT_SET_SIZE", 100000)
+	cfg.Precache.HotSetWindow = getEnvAsDuration("PRECACHE_HOT_SET_WINDOW", 7*24*time.Hour)
+	cfg.Precache.ActivityRetention = getEnvAsDuration("ACTIVITY_RETENTION", 30*24*time.Hour)
 	cfg.Precache.CronSchedule = getEnv("CRON_SCHEDULE", "* * * * *")
+	cfg.Precache.OverlapPolicy = getEnv("PRECACHE_OVERLAP_POLICY", "skip")
+	cfg.Precache.HistorySize = getEnvAsInt("PRECACHE_HISTORY_SIZE", 100)
+	cfg.Precache.Mode = getEnv("PRECACHE_MODE", "full")
+	cfg.Precache.FullSweepInterval = getEnvAsDuration("PRECACHE_FULL_SWEEP_INTERVAL", 24*time.Hour)
+	cfg.Precache.WatermarkOverlap = getEnvAsDuration("PRECACHE_WATERMARK_OVERLAP", time.Minute)
+
+	cfg.CDC.ServerID = getEnvAsInt("BINLOG_SERVER_ID", 1001)
+
+	cfg.Leader.InstanceID = getEnv("WORKER_INSTANCE_ID", "")
+	cfg.Leader.LeaseTTL = getEnvAsDuration("LEADER_LEASE_TTL", 15*time.Second)
 
 	cfg.Log.Level = getEnv("LOG_LEVEL", "debug")
 
 	cfg.Service.AuthBasicPort = getEnvAsInt("AUTH_BASIC_PORT", 8080)
 	cfg.Service.AuthImprovedPort = getEnvAsInt("AUTH_IMPROVED_PORT", 8081)
+	cfg.Service.PrecacheAdminHost = getEnv("PRECACHE_ADMIN_HOST", "127.0.0.1")
+	cfg.Service.PrecacheAdminPort = getEnvAsInt("PRECACHE_ADMIN_PORT", 8082)
+	cfg.Service.PrecacheAdminToken = getEnv("PRECACHE_ADMIN_TOKEN", "")
 
 	return cfg
 }
@@ -109,6 +240,19 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvAsSlice(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	return defaultValue
+}
+
 func getEnvAsInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -118,6 +262,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
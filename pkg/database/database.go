@@ -1,10 +1,15 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"substack-auth/pkg/config"
+	"substack-auth/pkg/models"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -31,6 +36,191 @@ func New(cfg *config.Config) (*Database, error) {
 	return &Database{DB: db}, nil
 }
 
+// UsersAfter returns up to limit users with an id greater than lastID in id
+// order. Passing the last id of each page back in walks the whole table with
+// cursor pagination.
+func (d *Database) UsersAfter(ctx context.Context, lastID int64, limit int) ([]models.User, error) {
+	var users []models.User
+	query := `SELECT id, username, password_hash, created_at FROM users WHERE id > ? ORDER BY id LIMIT ?`
+
+	err := d.DB.SelectContext(ctx, &users, query, lastID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// StreamUsers calls fn for every user with an id greater than afterID, in
+// id order, over a single streaming query. fn must keep up: MySQL aborts
+// the query if the client stops reading for longer than net_write_timeout.
+func (d *Database) StreamUsers(ctx context.Context, afterID int64, fn func(models.User) error) error {
+	query := `SELECT id, username, password_hash, created_at FROM users WHERE id > ? ORDER BY id`
+
+	rows, err := d.DB.QueryxContext(ctx, query, afterID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user models.User
+		if err := rows.StructScan(&user); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ChangedUser is a user row together with its last modification time, the
+// cursor column for incremental loads.
+type ChangedUser struct {
+	models.User
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// UsersChangedSince returns up to limit users modified at or after since,
+// ordered by (updated_at, id). Pass the last row's updated_at and id back in
+// as after and afterID to fetch the next page.
+func (d *Database) UsersChangedSince(ctx context.Context, since, after time.Time, afterID int64, limit int) ([]ChangedUser, error) {
+	var users []ChangedUser
+	query := `SELECT id, username, password_hash, created_at, updated_at FROM users
+		WHERE updated_at >= ? AND (updated_at > ? OR (updated_at = ? AND id > ?))
+		ORDER BY updated_at, id LIMIT ?`
+
+	err := d.DB.SelectContext(ctx, &users, query, since, after, after, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Now returns the database server's clock. Watermarks are taken from it so
+// they compare correctly with updated_at regardless of the worker's clock.
+func (d *Database) Now(ctx context.Context) (time.Time, error) {
+	var now time.Time
+	err := d.DB.GetContext(ctx, &now, `SELECT NOW(6)`)
+	return now, err
+}
+
+// State returns a value persisted with SetState, and whether it exists.
+func (d *Database) State(ctx context.Context, name string) (string, bool, error) {
+	var value string
+	err := d.DB.GetContext(ctx, &value, `SELECT value FROM precache_state WHERE name = ?`, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetState persists value under name, replacing any previous value.
+func (d *Database) SetState(ctx context.Context, name, value string) error {
+	query := `INSERT INTO precache_state (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)`
+	_, err := d.DB.ExecContext(ctx, query, name, value)
+	return err
+}
+
+// UsersByIDs returns the users with the given ids that still exist, in no
+// particular order.
+func (d *Database) UsersByIDs(ctx context.Context, ids []int64) ([]models.User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT id, username, password_hash, created_at FROM users WHERE id IN (?)`, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []models.User
+	if err := d.DB.SelectContext(ctx, &users, d.DB.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ExistingUsernames returns the subset of usernames that exist in the users
+// table.
+func (d *Database) ExistingUsernames(ctx context.Context, usernames []string) (map[string]bool, error) {
+	existing := make(map[string]bool, len(usernames))
+	if len(usernames) == 0 {
+		return existing, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT username FROM users WHERE username IN (?)`, usernames)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	if err := d.DB.SelectContext(ctx, &found, d.DB.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	for _, username := range found {
+		existing[username] = true
+	}
+	return existing, nil
+}
+
+// BinlogStatus returns the server's current binlog file and position, and
+// its binlog_checksum setting.
+func (d *Database) BinlogStatus(ctx context.Context) (string, uint32, string, error) {
+	var checksum string
+	if err := d.DB.GetContext(ctx, &checksum, `SELECT @@GLOBAL.binlog_checksum`); err != nil {
+		return "", 0, "", err
+	}
+
+	// MySQL 8.4 renamed SHOW MASTER STATUS.
+	rows, err := d.DB.QueryxContext(ctx, `SHOW BINARY LOG STATUS`)
+	if err != nil {
+		rows, err = d.DB.QueryxContext(ctx, `SHOW MASTER STATUS`)
+	}
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", 0, "", err
+		}
+		return "", 0, "", errors.New("binary logging is not enabled")
+	}
+
+	status := make(map[string]any)
+	if err := rows.MapScan(status); err != nil {
+		return "", 0, "", err
+	}
+
+	file := fmt.Sprintf("%s", status["File"])
+	var pos uint32
+	if _, err := fmt.Sscanf(fmt.Sprintf("%s", status["Position"]), "%d", &pos); err != nil {
+		return "", 0, "", fmt.Errorf("parse binlog position: %w", err)
+	}
+	return file, pos, checksum, nil
+}
+
+// ColumnNames returns the columns of a table in ordinal order, matching the
+// column order of binlog row images.
+func (d *Database) ColumnNames(ctx context.Context, table string) ([]string, error) {
+	var names []string
+	query := `SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`
+
+	if err := d.DB.SelectContext(ctx, &names, query, table); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
 func (d *Database) Close() error {
 	return d.DB.Close()
 }
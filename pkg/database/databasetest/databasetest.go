@@ -0,0 +1,381 @@
+// Package databasetest is an in-memory stand-in for the MySQL users and
+// precache_state tables. It answers exactly the queries issued by package
+// database and the auth services, so tests can run them without a server.
+package databasetest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/database"
+	"substack-auth/pkg/models"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// DB is a fake database. The embedded handle is what the code under test
+// should be given; the other methods set up and inspect its contents.
+type DB struct {
+	*database.Database
+
+	mu      sync.Mutex
+	users   []row
+	nextID  int64
+	state   map[string]string
+	columns []string
+	now     time.Time
+	binlog  binlogPosition
+	latency time.Duration
+	fail    error
+
+	queries atomic.Int64
+}
+
+type binlogPosition struct {
+	file string
+	pos  uint32
+}
+
+type row struct {
+	models.User
+	updatedAt time.Time
+}
+
+// New returns an empty database with the users table from schema.sql. It is
+// closed when the test ends.
+func New(t testing.TB) *DB {
+	t.Helper()
+
+	db := &DB{
+		nextID:  1,
+		state:   make(map[string]string),
+		columns: []string{"id", "username", "password_hash", "created_at", "updated_at"},
+		binlog:  binlogPosition{file: "binlog.000001", pos: 4},
+	}
+	db.Database = &database.Database{DB: sqlx.NewDb(sql.OpenDB(connector{db}), "mysql")}
+	t.Cleanup(func() { db.Database.Close() })
+	return db
+}
+
+// AddUser inserts a user as if by the seeder and returns it.
+func (db *DB) AddUser(username, passwordHash string) models.User {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, _ := db.insert(username, passwordHash)
+	return r.User
+}
+
+// User returns the stored row for username, matched case-insensitively like
+// the default MySQL collation.
+func (db *DB) User(username string) (models.User, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if i := db.find(username); i >= 0 {
+		return db.users[i].User, true
+	}
+	return models.User{}, false
+}
+
+// SetUpdatedAt overrides the updated_at column of the user with id.
+func (db *DB) SetUpdatedAt(id int64, at time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := range db.users {
+		if db.users[i].ID == id {
+			db.users[i].updatedAt = at
+		}
+	}
+}
+
+// SetColumns replaces the column list reported for the users table.
+func (db *DB) SetColumns(columns ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.columns = columns
+}
+
+// SetNow freezes the server clock at now. The zero time restores the real
+// clock.
+func (db *DB) SetNow(now time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.now = now
+}
+
+// SetBinlogPosition sets the position reported by SHOW BINARY LOG STATUS.
+func (db *DB) SetBinlogPosition(file string, pos uint32) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.binlog = binlogPosition{file: file, pos: pos}
+}
+
+// SetLatency delays every query by d.
+func (db *DB) SetLatency(d time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.latency = d
+}
+
+// SetError makes every query fail with err until it is reset to nil.
+func (db *DB) SetError(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.fail = err
+}
+
+// Queries returns the number of statements executed so far.
+func (db *DB) Queries() int64 {
+	return db.queries.Load()
+}
+
+func (db *DB) clock() time.Time {
+	if db.now.IsZero() {
+		return time.Now().UTC()
+	}
+	return db.now
+}
+
+func (db *DB) find(username string) int {
+	return slices.IndexFunc(db.users, func(r row) bool {
+		return strings.EqualFold(r.Username, username)
+	})
+}
+
+func (db *DB) insert(username, passwordHash string) (row, error) {
+	if db.find(username) >= 0 {
+		return row{}, &mysql.MySQLError{Number: 1062, Message: fmt.Sprintf("Duplicate entry '%s' for key 'users.username'", username)}
+	}
+
+	now := db.clock()
+	r := row{
+		User:      models.User{ID: db.nextID, Username: username, PasswordHash: passwordHash, CreatedAt: now.Truncate(time.Second)},
+		updatedAt: now,
+	}
+	db.nextID++
+	db.users = append(db.users, r)
+	return r, nil
+}
+
+// query runs a statement and returns its result set, or for statements
+// without one the number of affected rows.
+func (db *DB) query(ctx context.Context, query string, args []driver.NamedValue) (*rows, int64, error) {
+	db.queries.Add(1)
+
+	db.mu.Lock()
+	latency, fail := db.latency, db.fail
+	db.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	if fail != nil {
+		return nil, 0, fail
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	query = strings.Join(strings.Fields(query), " ")
+	arg := func(i int) driver.Value { return args[i].Value }
+
+	switch {
+	case query == "SELECT NOW(6)":
+		return newRows([]string{"NOW(6)"}, []driver.Value{db.clock()}), 0, nil
+
+	case query == "SELECT @@GLOBAL.binlog_checksum":
+		return newRows([]string{"@@GLOBAL.binlog_checksum"}, []driver.Value{"CRC32"}), 0, nil
+
+	case query == "SHOW BINARY LOG STATUS":
+		pos := strconv.FormatUint(uint64(db.binlog.pos), 10)
+		return newRows([]string{"File", "Position"}, []driver.Value{[]byte(db.binlog.file), []byte(pos)}), 0, nil
+
+	case query == "SELECT id, username, password_hash, created_at FROM users WHERE id > ? ORDER BY id LIMIT ?":
+		after, limit := arg(0).(int64), arg(1).(int64)
+		return db.userRows(func(r row) bool { return r.ID > after }, int(limit)), 0, nil
+
+	case query == "SELECT id, username, password_hash, created_at FROM users WHERE id > ? ORDER BY id":
+		after := arg(0).(int64)
+		return db.userRows(func(r row) bool { return r.ID > after }, -1), 0, nil
+
+	case query == "SELECT id, username, password_hash, created_at FROM users WHERE username = ?":
+		username := arg(0).(string)
+		return db.userRows(func(r row) bool { return strings.EqualFold(r.Username, username) }, -1), 0, nil
+
+	case strings.HasPrefix(query, "SELECT id, username, password_hash, created_at FROM users WHERE id IN ("):
+		ids := make(map[int64]bool, len(args))
+		for i := range args {
+			ids[arg(i).(int64)] = true
+		}
+		return db.userRows(func(r row) bool { return ids[r.ID] }, -1), 0, nil
+
+	case strings.HasPrefix(query, "SELECT username FROM users WHERE username IN ("):
+		result := newRows([]string{"username"})
+		for _, r := range db.users {
+			for i := range args {
+				if strings.EqualFold(r.Username, arg(i).(string)) {
+					result.values = append(result.values, []driver.Value{r.Username})
+					break
+				}
+			}
+		}
+		return result, 0, nil
+
+	case strings.HasPrefix(query, "SELECT id, username, password_hash, created_at, updated_at FROM users WHERE updated_at >= ?"):
+		since, after := arg(0).(time.Time), arg(1).(time.Time)
+		afterID, limit := arg(3).(int64), arg(4).(int64)
+
+		changed := slices.Clone(db.users)
+		slices.SortFunc(changed, func(a, b row) int {
+			if c := a.updatedAt.Compare(b.updatedAt); c != 0 {
+				return c
+			}
+			return int(a.ID - b.ID)
+		})
+		result := newRows([]string{"id", "username", "password_hash", "created_at", "updated_at"})
+		for _, r := range changed {
+			if len(result.values) == int(limit) {
+				break
+			}
+			if r.updatedAt.Before(since) || r.updatedAt.Before(after) || (r.updatedAt.Equal(after) && r.ID <= afterID) {
+				continue
+			}
+			result.values = append(result.values, []driver.Value{r.ID, r.Username, r.PasswordHash, r.CreatedAt, r.updatedAt})
+		}
+		return result, 0, nil
+
+	case strings.HasPrefix(query, "SELECT COLUMN_NAME FROM information_schema.COLUMNS"):
+		result := newRows([]string{"COLUMN_NAME"})
+		if arg(0).(string) == "users" {
+			for _, name := range db.columns {
+				result.values = append(result.values, []driver.Value{name})
+			}
+		}
+		return result, 0, nil
+
+	case query == "SELECT value FROM precache_state WHERE name = ?":
+		result := newRows([]string{"value"})
+		if value, ok := db.state[arg(0).(string)]; ok {
+			result.values = append(result.values, []driver.Value{value})
+		}
+		return result, 0, nil
+
+	case strings.HasPrefix(query, "INSERT INTO precache_state (name, value) VALUES (?, ?)"):
+		db.state[arg(0).(string)] = arg(1).(string)
+		return nil, 1, nil
+
+	case query == "INSERT INTO users (username, password_hash) VALUES (?, ?)":
+		if _, err := db.insert(arg(0).(string), arg(1).(string)); err != nil {
+			return nil, 0, err
+		}
+		return nil, 1, nil
+
+	case query == "UPDATE users SET password_hash = ? WHERE username = ?":
+		i := db.find(arg(1).(string))
+		if i < 0 {
+			return nil, 0, nil
+		}
+		db.users[i].PasswordHash = arg(0).(string)
+		db.users[i].updatedAt = db.clock()
+		return nil, 1, nil
+
+	case query == "DELETE FROM users WHERE username = ?":
+		i := db.find(arg(0).(string))
+		if i < 0 {
+			return nil, 0, nil
+		}
+		db.users = slices.Delete(db.users, i, i+1)
+		return nil, 1, nil
+	}
+
+	return nil, 0, fmt.Errorf("databasetest: unsupported query %q", query)
+}
+
+// userRows returns the id, username, password_hash and created_at of the
+// first limit users matching keep in id order. A negative limit returns all
+// of them.
+func (db *DB) userRows(keep func(row) bool, limit int) *rows {
+	result := newRows([]string{"id", "username", "password_hash", "created_at"})
+	for _, r := range db.users {
+		if len(result.values) == limit {
+			break
+		}
+		if keep(r) {
+			result.values = append(result.values, []driver.Value{r.ID, r.Username, r.PasswordHash, r.CreatedAt})
+		}
+	}
+	return result
+}
+
+type connector struct{ db *DB }
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return conn(c), nil }
+func (c connector) Driver() driver.Driver                        { return nil }
+
+type conn struct{ db *DB }
+
+var errNoPrepare = errors.New("databasetest: prepared statements are not supported")
+
+func (c conn) Prepare(string) (driver.Stmt, error) { return nil, errNoPrepare }
+func (c conn) Close() error                        { return nil }
+func (c conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("databasetest: transactions are not supported")
+}
+
+func (c conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, _, err := c.db.query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return newRows(nil), nil
+	}
+	return result, nil
+}
+
+func (c conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, affected, err := c.db.query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func newRows(columns []string, values ...[]driver.Value) *rows {
+	return &rows{columns: columns, values: values}
+}
+
+func (r *rows) Columns() []string { return r.columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
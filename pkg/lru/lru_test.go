@@ -0,0 +1,55 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[int](2, 0)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b survived, want it evicted as least recently used")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if got, ok := c.Get(key); !ok || got != want {
+			t.Errorf("Get(%q) = %d, %v, want %d, true", key, got, ok, want)
+		}
+	}
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len = %d, want 2", got)
+	}
+}
+
+func TestExpiresAfterTTL(t *testing.T) {
+	c := New[int](10, 10*time.Millisecond)
+	c.Set("a", 1)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("entry returned after its TTL")
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len = %d, want expired entry removed", got)
+	}
+}
+
+func TestDeleteAndPurge(t *testing.T) {
+	c := New[int](10, 0)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("deleted entry returned")
+	}
+
+	c.Purge()
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len after Purge = %d, want 0", got)
+	}
+}
@@ -14,6 +14,16 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
 type LoginResponse struct {
 	Token string       `json:"token"`
 	User  UserResponse `json:"user"`
@@ -24,3 +34,24 @@ type UserResponse struct {
 	Username  string    `json:"username"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// CacheStats reports how auth-improved served user lookups.
+type CacheStats struct {
+	CacheMisses         int64 `json:"cache_misses"`
+	DatabaseLoads       int64 `json:"database_loads"`
+	Coalesced           int64 `json:"coalesced"`
+	FillLockAcquired    int64 `json:"fill_lock_acquired"`
+	FillLockContended   int64 `json:"fill_lock_contended"`
+	FillLockServedCache int64 `json:"fill_lock_served_from_cache"`
+	FillLockNotFound    int64 `json:"fill_lock_not_found"`
+	StaleServed         int64 `json:"stale_served"`
+	BackgroundRefreshes int64 `json:"background_refreshes"`
+	CacheWriteFailures  int64 `json:"cache_write_failures"`
+	IntegrityFailures   int64 `json:"integrity_failures"`
+	RefreshesQueued     int64 `json:"refreshes_queued"`
+	RefreshQueueFull    int64 `json:"refresh_queue_full"`
+
+	BreakerState    string `json:"breaker_state,omitempty"`
+	BreakerOpened   int64  `json:"breaker_opened"`
+	BreakerRejected int64  `json:"breaker_rejected"`
+}
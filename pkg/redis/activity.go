@@ -0,0 +1,74 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The activity set is a sorted set of user ids scored by their last login
+// time. One ZADD per login keeps it current at O(log n) cost, and it holds
+// ids rather than usernames so it reveals nothing when keys are
+// pseudonymous.
+func (r *Redis) activityKey() string {
+	return r.internalKey("activity")
+}
+
+// RecordLogin marks userID as active at the given time.
+func (r *Redis) RecordLogin(ctx context.Context, userID int64, at time.Time) error {
+	return r.client.ZAdd(ctx, r.activityKey(), redis.Z{
+		Score:  float64(at.Unix()),
+		Member: strconv.FormatInt(userID, 10),
+	}).Err()
+}
+
+// ActiveUsers returns the ids of users who logged in at or after since,
+// most recent first, at most limit of them. A zero since or limit means no
+// bound.
+func (r *Redis) ActiveUsers(ctx context.Context, since time.Time, limit int) ([]int64, error) {
+	min := "-inf"
+	if !since.IsZero() {
+		min = strconv.FormatInt(since.Unix(), 10)
+	}
+
+	members, err := r.client.ZRevRangeByScore(ctx, r.activityKey(), &redis.ZRangeBy{
+		Min:   min,
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// PruneActivity drops users whose last login is before the given time and
+// returns how many were removed.
+func (r *Redis) PruneActivity(ctx context.Context, before time.Time) (int64, error) {
+	return r.client.ZRemRangeByScore(ctx, r.activityKey(), "-inf", "("+strconv.FormatInt(before.Unix(), 10)).Result()
+}
+
+// ForgetActivity removes users, e.g. ones that no longer exist, from the
+// activity set.
+func (r *Redis) ForgetActivity(ctx context.Context, userIDs []int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	members := make([]any, len(userIDs))
+	for i, id := range userIDs {
+		members[i] = strconv.FormatInt(id, 10)
+	}
+	return r.client.ZRem(ctx, r.activityKey(), members...).Err()
+}
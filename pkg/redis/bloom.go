@@ -0,0 +1,221 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"substack-auth/pkg/bloom"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The username filter lives in a generation-stamped key. A small meta hash
+// points readers at the current generation together with the parameters
+// needed to compute bit offsets, so the worker can build a fresh filter and
+// swap it in atomically on every run. While a rebuild is in progress,
+// usernames added to the live filter are also journaled so they can be
+// replayed into the new generation after the swap. All keys share the
+// {bloom} hash tag so the scripts and transactions stay in one cluster slot.
+const (
+	bloomKeyPrefix   = "{bloom}:"
+	bloomMetaKey     = bloomKeyPrefix + "meta"
+	bloomRebuildKey  = bloomKeyPrefix + "rebuild"
+	bloomJournalKey  = bloomKeyPrefix + "journal"
+	bloomAddAttempts = 3
+)
+
+// bloomAddScript sets the given bits in the filter generation KEYS[4] the
+// caller computed them for, and journals the username while a rebuild runs.
+// It returns 0 without writing when the meta hash has moved to another
+// generation in the meantime, so the caller recomputes for the new one.
+var bloomAddScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "key") ~= KEYS[4] then
+	return 0
+end
+for i = 2, #ARGV do
+	redis.call("SETBIT", KEYS[4], ARGV[i], 1)
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	redis.call("SADD", KEYS[3], ARGV[1])
+	redis.call("PEXPIRE", KEYS[3], redis.call("PTTL", KEYS[2]))
+end
+return 1
+`)
+
+// BloomItem is the form of username stored in the filter. MySQL compares
+// usernames case-insensitively, so the filter must not tell "Test@x.com"
+// from "test@x.com" either. Everything that adds to or tests the filter
+// goes through it.
+func BloomItem(username string) string {
+	return strings.ToLower(username)
+}
+
+// ErrBloomUnavailable is returned when no usable filter is published, either
+// because the worker has not built one yet or because it expired or was
+// evicted. Callers must treat it as "unknown" and not reject the lookup.
+var ErrBloomUnavailable = errors.New("bloom filter unavailable")
+
+type bloomMeta struct {
+	key    string
+	bits   uint64
+	hashes uint64
+}
+
+// BeginBloomRebuild starts journaling BloomAdd calls. The worker calls it
+// before it starts reading users for a new filter, so a user created after
+// that read began is replayed into the new filter by PublishBloom. The
+// journal expires with the cache TTL if the rebuild is abandoned.
+func (r *Redis) BeginBloomRebuild(ctx context.Context) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, r.internalKey(bloomJournalKey))
+	pipe.Set(ctx, r.internalKey(bloomRebuildKey), "1", r.ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// PublishBloom stores f as a new filter generation, points the meta hash at
+// it, replays the usernames journaled since BeginBloomRebuild into it and
+// removes the previous generation. Additions after the swap go to the new
+// generation directly. The filter shares the cache TTL so a stopped worker
+// cannot leave a stale filter rejecting new users forever.
+func (r *Redis) PublishBloom(ctx context.Context, f *bloom.Filter) error {
+	previous, err := r.bloomMeta(ctx)
+	if err != nil && !errors.Is(err, ErrBloomUnavailable) {
+		return err
+	}
+
+	key := r.internalKey(bloomKeyPrefix + strconv.FormatInt(time.Now().UnixNano(), 10))
+	metaKey := r.internalKey(bloomMetaKey)
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, key, f.Bytes(), r.ttl)
+	pipe.HSet(ctx, metaKey, "key", key, "bits", f.Bits(), "hashes", f.Hashes())
+	pipe.Expire(ctx, metaKey, r.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to publish bloom filter: %w", err)
+	}
+
+	journaled, err := r.client.SMembers(ctx, r.internalKey(bloomJournalKey)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read bloom journal: %w", err)
+	}
+	if len(journaled) > 0 {
+		replay := r.client.Pipeline()
+		for _, username := range journaled {
+			for _, loc := range bloom.Locations(username, f.Bits(), f.Hashes()) {
+				replay.SetBit(ctx, key, int64(loc), 1)
+			}
+		}
+		if _, err := replay.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to replay bloom journal: %w", err)
+		}
+	}
+	if err := r.client.Del(ctx, r.internalKey(bloomRebuildKey), r.internalKey(bloomJournalKey)).Err(); err != nil {
+		return fmt.Errorf("failed to finish bloom rebuild: %w", err)
+	}
+
+	if previous != nil && previous.key != key {
+		if err := r.client.Del(ctx, previous.key).Err(); err != nil {
+			return fmt.Errorf("failed to remove previous bloom filter: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// BloomMayContain reports whether username may exist. A false result means
+// the username is definitely not in the published filter.
+func (r *Redis) BloomMayContain(ctx context.Context, username string) (bool, error) {
+	meta, err := r.bloomMeta(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	locs := bloom.Locations(BloomItem(username), meta.bits, meta.hashes)
+
+	pipe := r.client.Pipeline()
+	exists := pipe.Exists(ctx, meta.key)
+	bits := make([]*redis.IntCmd, len(locs))
+	for i, loc := range locs {
+		bits[i] = pipe.GetBit(ctx, meta.key, int64(loc))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+
+	// GETBIT on a missing key returns 0, which would reject everyone.
+	if exists.Val() == 0 {
+		return false, ErrBloomUnavailable
+	}
+
+	for _, bit := range bits {
+		if bit.Val() == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// BloomAdd sets username's bits in the current filter generation so users
+// created between worker runs are not rejected. It is a no-op when no
+// filter is published. During a rebuild the username is also journaled, so
+// it survives the swap to the new generation.
+func (r *Redis) BloomAdd(ctx context.Context, username string) error {
+	item := BloomItem(username)
+
+	for range bloomAddAttempts {
+		meta, err := r.bloomMeta(ctx)
+		if err != nil {
+			if errors.Is(err, ErrBloomUnavailable) {
+				return nil
+			}
+			return err
+		}
+
+		locs := bloom.Locations(item, meta.bits, meta.hashes)
+		args := make([]any, 0, len(locs)+1)
+		args = append(args, item)
+		for _, loc := range locs {
+			args = append(args, loc)
+		}
+
+		keys := []string{r.internalKey(bloomMetaKey), r.internalKey(bloomRebuildKey), r.internalKey(bloomJournalKey), meta.key}
+		added, err := bloomAddScript.Run(ctx, r.client, keys, args...).Int()
+		if err != nil {
+			return err
+		}
+		if added == 1 {
+			return nil
+		}
+	}
+	return errors.New("bloom filter generation kept changing")
+}
+
+func (r *Redis) bloomMeta(ctx context.Context) (*bloomMeta, error) {
+	values, err := r.client.HMGet(ctx, r.internalKey(bloomMetaKey), "key", "bits", "hashes").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := values[0].(string)
+	rawBits, _ := values[1].(string)
+	rawHashes, _ := values[2].(string)
+	if key == "" || rawBits == "" || rawHashes == "" {
+		return nil, ErrBloomUnavailable
+	}
+
+	bits, err := strconv.ParseUint(rawBits, 10, 64)
+	if err != nil || bits == 0 {
+		return nil, ErrBloomUnavailable
+	}
+	hashes, err := strconv.ParseUint(rawHashes, 10, 64)
+	if err != nil || hashes == 0 {
+		return nil, ErrBloomUnavailable
+	}
+
+	return &bloomMeta{key: key, bits: bits, hashes: hashes}, nil
+}
@@ -0,0 +1,88 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"substack-auth/pkg/bloom"
+)
+
+func publishTestBloom(t *testing.T, r *Redis, usernames ...string) {
+	t.Helper()
+
+	f := bloom.NewWithEstimates(1000, 0.01)
+	for _, username := range usernames {
+		f.Add(BloomItem(username))
+	}
+	if err := r.PublishBloom(context.Background(), f); err != nil {
+		t.Fatalf("PublishBloom: %v", err)
+	}
+}
+
+func TestBloomUnavailable(t *testing.T) {
+	_, r := newTestRedis(t, nil)
+	ctx := context.Background()
+
+	if _, err := r.BloomMayContain(ctx, "test@katakode.com"); !errors.Is(err, ErrBloomUnavailable) {
+		t.Errorf("BloomMayContain err = %v, want %v", err, ErrBloomUnavailable)
+	}
+	if err := r.BloomAdd(ctx, "test@katakode.com"); err != nil {
+		t.Errorf("BloomAdd without a filter: %v", err)
+	}
+}
+
+func TestBloomIgnoresCase(t *testing.T) {
+	_, r := newTestRedis(t, nil)
+	ctx := context.Background()
+	publishTestBloom(t, r, "test@katakode.com")
+
+	for _, username := range []string{"test@katakode.com", "Test@katakode.com", "TEST@KATAKODE.COM"} {
+		ok, err := r.BloomMayContain(ctx, username)
+		if err != nil {
+			t.Fatalf("BloomMayContain(%q): %v", username, err)
+		}
+		if !ok {
+			t.Errorf("BloomMayContain(%q) = false for stored user test@katakode.com", username)
+		}
+	}
+
+	if err := r.BloomAdd(ctx, "New.User@katakode.com"); err != nil {
+		t.Fatalf("BloomAdd: %v", err)
+	}
+	if ok, _ := r.BloomMayContain(ctx, "new.user@katakode.com"); !ok {
+		t.Error("BloomMayContain = false for a user added with different case")
+	}
+}
+
+func TestBloomRebuildReplaysAdds(t *testing.T) {
+	_, r := newTestRedis(t, nil)
+	ctx := context.Background()
+	publishTestBloom(t, r, "old@katakode.com")
+
+	if err := r.BeginBloomRebuild(ctx); err != nil {
+		t.Fatalf("BeginBloomRebuild: %v", err)
+	}
+	// Created after the sweep read the users table, so missing from the
+	// filter it builds.
+	if err := r.BloomAdd(ctx, "Late@katakode.com"); err != nil {
+		t.Fatalf("BloomAdd: %v", err)
+	}
+	publishTestBloom(t, r, "old@katakode.com")
+
+	if ok, _ := r.BloomMayContain(ctx, "late@katakode.com"); !ok {
+		t.Error("user added during the rebuild is missing from the new filter")
+	}
+
+	// Once published, adds go straight to the new generation and are no
+	// longer journaled.
+	if err := r.BloomAdd(ctx, "after@katakode.com"); err != nil {
+		t.Fatalf("BloomAdd: %v", err)
+	}
+	if n, _ := r.client.Exists(ctx, r.internalKey(bloomJournalKey)).Result(); n != 0 {
+		t.Error("journal kept after the rebuild finished")
+	}
+	if ok, _ := r.BloomMayContain(ctx, "after@katakode.com"); !ok {
+		t.Error("user added after the swap is missing")
+	}
+}
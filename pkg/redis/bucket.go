@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// In the hash layout users are spread over a fixed number of Redis hashes so
+// that each hash stays small enough for Redis' compact listpack encoding.
+//
+// Hash fields cannot expire on their own, so buckets are stamped with a
+// generation derived from the clock: generation = unix time / TTL. Writes
+// go to the current generation and the bucket key expires after two TTLs;
+// reads look in the current generation first and then the previous one. An
+// entry therefore lives for at least one and at most two TTLs, the same
+// guarantee a refreshed string key gets from the precache worker.
+const (
+	LayoutString = "string"
+	LayoutHash   = "hash"
+)
+
+func (r *Redis) bucketKey(generation int64, field string) string {
+	h := fnv.New32a()
+	h.Write([]byte(field))
+	bucket := h.Sum32() % uint32(r.buckets)
+
+	return r.internalKey("bucket:" + strconv.FormatInt(generation, 10) + ":" + strconv.FormatUint(uint64(bucket), 10))
+}
+
+// CheckListpack warns when cache values of valueSize bytes exceed Redis'
+// hash-max-listpack-value. A single such field converts its bucket to the
+// hashtable encoding, which costs more memory than string keys would. It
+// does nothing for the string layout, or if the setting cannot be read.
+func (r *Redis) CheckListpack(ctx context.Context, valueSize int) {
+	if r.layout != LayoutHash {
+		return
+	}
+
+	config, err := r.client.ConfigGet(ctx, "hash-max-listpack-value").Result()
+	if err != nil {
+		slog.Warn("Failed to read hash-max-listpack-value", "error", err)
+		return
+	}
+	limit, err := strconv.Atoi(config["hash-max-listpack-value"])
+	if err != nil {
+		return
+	}
+	if valueSize > limit {
+		slog.Warn("Cache values are larger than hash-max-listpack-value; buckets will not use the listpack encoding",
+			"value_size", valueSize, "hash_max_listpack_value", limit)
+	}
+}
+
+func (r *Redis) generation(now time.Time) int64 {
+	ttl := int64(r.ttl / time.Second)
+	if ttl <= 0 {
+		ttl = 1
+	}
+	return now.Unix() / ttl
+}
+
+func (r *Redis) hashSet(ctx context.Context, pipe redis.Pipeliner, field, value string, touched map[string]bool) {
+	key := r.bucketKey(r.generation(time.Now()), field)
+	pipe.HSet(ctx, key, field, value)
+	if !touched[key] {
+		touched[key] = true
+		pipe.Expire(ctx, key, r.ttl+r.expiry())
+	}
+}
+
+func (r *Redis) hashGet(ctx context.Context, field string) (string, error) {
+	current := r.generation(time.Now())
+
+	pipe := r.client.Pipeline()
+	cur := pipe.HGet(ctx, r.bucketKey(current, field), field)
+	prev := pipe.HGet(ctx, r.bucketKey(current-1, field), field)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	if value, err := cur.Result(); err == nil {
+		return value, nil
+	}
+	return prev.Result()
+}
+
+// hashDel removes field from both generations a reader would look in.
+func (r *Redis) hashDel(ctx context.Context, field string) error {
+	current := r.generation(time.Now())
+
+	pipe := r.client.Pipeline()
+	pipe.HDel(ctx, r.bucketKey(current, field), field)
+	pipe.HDel(ctx, r.bucketKey(current-1, field), field)
+	_, err := pipe.Exec(ctx)
+	return err
+}
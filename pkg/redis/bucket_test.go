@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/config"
+)
+
+func TestGeneration(t *testing.T) {
+	r := &Redis{ttl: time.Hour}
+	start := time.Unix(10*3600, 0)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want int64
+	}{
+		{"start of generation", start, 10},
+		{"end of generation", start.Add(time.Hour - time.Second), 10},
+		{"next generation", start.Add(time.Hour), 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.generation(tt.at); got != tt.want {
+				t.Errorf("generation = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketKey(t *testing.T) {
+	r := &Redis{prefix: "auth:", buckets: 16}
+
+	key := r.bucketKey(7, "test@katakode.com")
+	if key != r.bucketKey(7, "test@katakode.com") {
+		t.Fatal("bucketKey is not deterministic")
+	}
+	if !strings.HasPrefix(key, "_auth:bucket:7:") {
+		t.Errorf("bucketKey = %q, want prefix _auth:bucket:7:", key)
+	}
+	if other := r.bucketKey(8, "test@katakode.com"); strings.TrimPrefix(other, "_auth:bucket:8:") != strings.TrimPrefix(key, "_auth:bucket:7:") {
+		t.Errorf("field moved buckets between generations: %q and %q", key, other)
+	}
+
+	used := make(map[string]bool)
+	for i := range 1000 {
+		used[r.bucketKey(7, fmt.Sprintf("user%d@katakode.com", i))] = true
+	}
+	if len(used) != 16 {
+		t.Errorf("1000 fields landed in %d buckets, want all 16", len(used))
+	}
+}
+
+// Usernames are arbitrary strings, so bucket keys must not share the user
+// keyspace or a user named like a bucket would be hidden from scans.
+func TestBucketKeysOutsideUserKeyspace(t *testing.T) {
+	for _, layout := range []string{LayoutString, LayoutHash} {
+		t.Run(layout, func(t *testing.T) {
+			mr, r := newTestRedis(t, func(cfg *config.Config) { cfg.Redis.Layout = layout })
+			ctx := context.Background()
+
+			names := []string{"bucket:0:1", "test@katakode.com"}
+			for _, name := range names {
+				if err := r.Set(ctx, name, "value"); err != nil {
+					t.Fatalf("Set(%q): %v", name, err)
+				}
+			}
+
+			var scanned []string
+			err := r.ScanKeys(ctx, func(batch []string) error {
+				scanned = append(scanned, batch...)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ScanKeys: %v", err)
+			}
+			slices.Sort(scanned)
+			if !slices.Equal(scanned, names) {
+				t.Errorf("ScanKeys = %v, want %v", scanned, names)
+			}
+
+			if layout == LayoutHash {
+				for _, key := range mr.Keys() {
+					if strings.HasPrefix(key, "auth:") {
+						t.Errorf("bucket stored in the user keyspace as %q", key)
+					}
+				}
+			}
+		})
+	}
+}
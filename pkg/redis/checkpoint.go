@@ -0,0 +1,28 @@
+package redis
+
+import (
+	"context"
+	"time"
+)
+
+// SaveCheckpoint stores fields under the named checkpoint and keeps it for
+// ttl after the last save.
+func (r *Redis) SaveCheckpoint(ctx context.Context, name string, fields map[string]any, ttl time.Duration) error {
+	key := r.internalKey("checkpoint:" + name)
+
+	pipe := r.client.TxPipeline()
+	pipe.HSet(ctx, key, fields)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// LoadCheckpoint returns the named checkpoint, or an empty map if there is
+// none.
+func (r *Redis) LoadCheckpoint(ctx context.Context, name string) (map[string]string, error) {
+	return r.client.HGetAll(ctx, r.internalKey("checkpoint:"+name)).Result()
+}
+
+func (r *Redis) ClearCheckpoint(ctx context.Context, name string) error {
+	return r.client.Del(ctx, r.internalKey("checkpoint:"+name)).Err()
+}
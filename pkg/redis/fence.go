@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrFenced is returned by a fenced write once a later tenure of its lease
+// has started.
+var ErrFenced = errors.New("lease passed to a later holder")
+
+type fenceKey struct{}
+
+type fence struct {
+	key  string
+	term int64
+}
+
+// WithFence returns a context whose cache writes (SetBatch, DeleteNames and
+// DeleteBatch) are applied only while term is still the latest tenure of the
+// named lease, as handed out by AcquireLease. A holder that lost the lease
+// in the middle of a batch then cannot overwrite its successor's entries.
+func (r *Redis) WithFence(ctx context.Context, name string, term int64) context.Context {
+	_, key := r.leaseKeys(name)
+	return context.WithValue(ctx, fenceKey{}, fence{key: key, term: term})
+}
+
+// writeFenced sends the commands queued by fn in one round trip. When ctx
+// carries a fence they run in a MULTI/EXEC transaction that watches the
+// lease's fencing counter, so they are dropped with ErrFenced if another
+// holder acquired the lease after the check. A transaction cannot span
+// cluster slots, so in cluster mode the counter is checked just before the
+// pipeline is sent instead, which narrows the race but does not close it.
+func (r *Redis) writeFenced(ctx context.Context, fn func(pipe redis.Pipeliner)) error {
+	queue := func(pipe redis.Pipeliner) error {
+		fn(pipe)
+		return nil
+	}
+
+	f, ok := ctx.Value(fenceKey{}).(fence)
+	if !ok {
+		_, err := r.client.Pipelined(ctx, queue)
+		return err
+	}
+
+	if _, cluster := r.client.(*redis.ClusterClient); cluster {
+		if err := f.check(ctx, r.client); err != nil {
+			return err
+		}
+		_, err := r.client.Pipelined(ctx, queue)
+		return err
+	}
+
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		if err := f.check(ctx, tx); err != nil {
+			return err
+		}
+		_, err := tx.TxPipelined(ctx, queue)
+		return err
+	}, f.key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrFenced
+	}
+	return err
+}
+
+func (f fence) check(ctx context.Context, client redis.Cmdable) error {
+	term, err := client.Get(ctx, f.key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return ErrFenced
+	}
+	if err != nil {
+		return err
+	}
+	if term != f.term {
+		return ErrFenced
+	}
+	return nil
+}
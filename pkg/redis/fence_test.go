@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFencedWritesStopAfterTakeover(t *testing.T) {
+	mr, r := newTestRedis(t, nil)
+	ctx := context.Background()
+
+	term, ok, err := r.AcquireLease(ctx, "test", "old", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("AcquireLease = %d, %v, %v", term, ok, err)
+	}
+	fenced := r.WithFence(ctx, "test", term)
+
+	if err := r.SetBatch(fenced, map[string]string{"test@katakode.com": "v1"}); err != nil {
+		t.Fatalf("SetBatch while holding the lease: %v", err)
+	}
+
+	// The old holder stalls past its lease and a new one takes over.
+	mr.FastForward(2 * time.Second)
+	if _, ok, err := r.AcquireLease(ctx, "test", "new", time.Second); err != nil || !ok {
+		t.Fatalf("AcquireLease by the successor = %v, %v", ok, err)
+	}
+
+	if err := r.SetBatch(fenced, map[string]string{"test@katakode.com": "stale"}); !errors.Is(err, ErrFenced) {
+		t.Errorf("SetBatch after takeover err = %v, want %v", err, ErrFenced)
+	}
+	if err := r.DeleteNames(fenced, []string{"test@katakode.com"}); !errors.Is(err, ErrFenced) {
+		t.Errorf("DeleteNames after takeover err = %v, want %v", err, ErrFenced)
+	}
+	if value, err := r.Get(ctx, "test@katakode.com"); err != nil || value != "v1" {
+		t.Errorf("Get = %q, %v, want the value untouched", value, err)
+	}
+
+	// Writes without a fence, such as auth-improved's, are unaffected.
+	if err := r.SetBatch(ctx, map[string]string{"test@katakode.com": "v2"}); err != nil {
+		t.Errorf("unfenced SetBatch: %v", err)
+	}
+}
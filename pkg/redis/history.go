@@ -0,0 +1,21 @@
+package redis
+
+import "context"
+
+// PushHistory prepends value to the named history list and trims it to the
+// newest keep entries.
+func (r *Redis) PushHistory(ctx context.Context, name, value string, keep int) error {
+	key := r.internalKey("history:" + name)
+
+	pipe := r.client.TxPipeline()
+	pipe.LPush(ctx, key, value)
+	pipe.LTrim(ctx, key, 0, int64(keep)-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// History returns up to limit entries of the named history list, newest
+// first.
+func (r *Redis) History(ctx context.Context, name string, limit int) ([]string, error) {
+	return r.client.LRange(ctx, r.internalKey("history:"+name), 0, int64(limit)-1).Result()
+}
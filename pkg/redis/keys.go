@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// minKeySecretLen is the shortest key hash secret accepted; anyone who can
+// guess the secret can map every stored key back to its username.
+const minKeySecretLen = 32
+
+// placeholderKeySecret is the example value once shipped in env.example; it
+// is public and must never be used.
+const placeholderKeySecret = "change-me-to-a-long-random-string"
+
+func checkKeySecret(secret string) error {
+	switch {
+	case secret == "":
+		return fmt.Errorf("REDIS_KEY_HASH_SECRET is required when key hashing is enabled")
+	case secret == placeholderKeySecret:
+		return fmt.Errorf("REDIS_KEY_HASH_SECRET is the example placeholder; generate a random one")
+	case len(secret) < minKeySecretLen:
+		return fmt.Errorf("REDIS_KEY_HASH_SECRET is %d bytes, want at least %d", len(secret), minKeySecretLen)
+	}
+	return nil
+}
+
+// KeyFor returns the name username is stored under in the user keyspace.
+// With key hashing enabled this is a keyed hash (HMAC-SHA256 truncated to
+// 128 bits), so listing the keyspace reveals no usernames; only holders of
+// the secret can map a username to its key. Every reader and writer of user
+// entries goes through this, so the layout stays consistent.
+func (r *Redis) KeyFor(username string) string {
+	if r.keySecret == nil {
+		return username
+	}
+
+	mac := hmac.New(sha256.New, r.keySecret)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// PseudonymousKeys reports whether user entries are stored under hashed
+// names rather than usernames.
+func (r *Redis) PseudonymousKeys() bool {
+	return r.keySecret != nil
+}
+
+// Locate returns the Redis key holding username's entry and, for the hash
+// layout, the field within it. It is meant for operator tooling.
+func (r *Redis) Locate(username string) (key, field string) {
+	name := r.KeyFor(username)
+	if r.layout == LayoutHash {
+		return r.bucketKey(r.generation(time.Now()), name), name
+	}
+	return r.prefix + name, ""
+}
@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyHashSecretChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr string
+	}{
+		{"empty", "", "required"},
+		{"example placeholder", placeholderKeySecret, "placeholder"},
+		{"too short", "0123456789abcdef", "at least 32"},
+		{"long enough", strings.Repeat("s", minKeySecretLen), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkKeySecret(tt.secret)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkKeySecret: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkKeySecret err = %v, want %q", err, tt.wantErr)
+			}
+			if err != nil && tt.secret != "" && strings.Contains(err.Error(), tt.secret) {
+				t.Error("error message echoes the secret")
+			}
+		})
+	}
+}
+
+func TestKeyForIsKeyed(t *testing.T) {
+	a := &Redis{keySecret: []byte(strings.Repeat("a", minKeySecretLen))}
+	b := &Redis{keySecret: []byte(strings.Repeat("b", minKeySecretLen))}
+
+	name := a.KeyFor("test@katakode.com")
+	if name == "test@katakode.com" || len(name) != 32 {
+		t.Errorf("KeyFor = %q, want a 128-bit hex pseudonym", name)
+	}
+	if name != a.KeyFor("test@katakode.com") {
+		t.Error("KeyFor is not deterministic")
+	}
+	if name == b.KeyFor("test@katakode.com") {
+		t.Error("KeyFor does not depend on the secret")
+	}
+}
@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// releaseScript deletes the lock only if it is still held by the caller, so
+// a holder whose lock already expired cannot release someone else's.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// AcquireLock tries once to take the named lock for ttl. It returns the
+// token needed to release it and whether the lock was acquired.
+func (r *Redis) AcquireLock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	ok, err := r.client.SetNX(ctx, r.internalKey("lock:"+name), token, ttl).Result()
+	if err != nil {
+		return "", false, err
+	}
+	return token, ok, nil
+}
+
+func (r *Redis) ReleaseLock(ctx context.Context, name, token string) error {
+	return releaseScript.Run(ctx, r.client, []string{r.internalKey("lock:" + name)}, token).Err()
+}
+
+// MarkMissing records for ttl that the holder of the named lock found
+// nothing to load, so callers waiting on the lock can stop waiting.
+func (r *Redis) MarkMissing(ctx context.Context, name string, ttl time.Duration) error {
+	return r.client.Set(ctx, r.internalKey("missing:"+name), "1", ttl).Err()
+}
+
+// Missing reports whether MarkMissing was recently called for name.
+func (r *Redis) Missing(ctx context.Context, name string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.internalKey("missing:"+name)).Result()
+	return n > 0, err
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
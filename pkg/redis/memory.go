@@ -0,0 +1,115 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MemoryUsage is the used_memory and maxmemory reported by INFO memory.
+// Max is zero when Redis has no memory limit.
+type MemoryUsage struct {
+	Used int64
+	Max  int64
+}
+
+// Fraction returns Used/Max, or 0 when there is no limit.
+func (m MemoryUsage) Fraction() float64 {
+	if m.Max <= 0 {
+		return 0
+	}
+	return float64(m.Used) / float64(m.Max)
+}
+
+// Memory returns the memory usage of the fullest node: in cluster mode that
+// is the master closest to its maxmemory, since it evicts first.
+func (r *Redis) Memory(ctx context.Context) (MemoryUsage, error) {
+	var (
+		mu    sync.Mutex
+		worst MemoryUsage
+		found bool
+	)
+
+	err := r.forEachNode(ctx, func(ctx context.Context, client redis.Cmdable) error {
+		info, err := client.Info(ctx, "memory").Result()
+		if err != nil {
+			return err
+		}
+		usage := parseMemoryInfo(info)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !found || usage.Fraction() > worst.Fraction() {
+			worst, found = usage, true
+		}
+		return nil
+	})
+	return worst, err
+}
+
+func parseMemoryInfo(info string) MemoryUsage {
+	var usage MemoryUsage
+	for line := range strings.SplitSeq(info, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "used_memory":
+			usage.Used, _ = strconv.ParseInt(value, 10, 64)
+		case "maxmemory":
+			usage.Max, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return usage
+}
+
+// CachedNames reports which of the given usernames currently have a cache
+// entry, without fetching the values.
+func (r *Redis) CachedNames(ctx context.Context, usernames []string) (map[string]bool, error) {
+	cached := make(map[string]bool, len(usernames))
+	if len(usernames) == 0 {
+		return cached, nil
+	}
+
+	pipe := r.client.Pipeline()
+	current := r.generation(time.Now())
+	cmds := make(map[string][]*redis.IntCmd, len(usernames))
+	for _, username := range usernames {
+		name := r.KeyFor(username)
+		if r.layout == LayoutHash {
+			cmds[username] = []*redis.IntCmd{
+				hexists(ctx, pipe, r.bucketKey(current, name), name),
+				hexists(ctx, pipe, r.bucketKey(current-1, name), name),
+			}
+			continue
+		}
+		cmds[username] = []*redis.IntCmd{pipe.Exists(ctx, r.prefix+name)}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for username, usernameCmds := range cmds {
+		for _, cmd := range usernameCmds {
+			if cmd.Val() > 0 {
+				cached[username] = true
+				break
+			}
+		}
+	}
+	return cached, nil
+}
+
+// hexists queues HEXISTS as an integer reply so both layouts share one
+// result type.
+func hexists(ctx context.Context, pipe redis.Pipeliner, key, field string) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx, "hexists", key, field)
+	_ = pipe.Process(ctx, cmd)
+	return cmd
+}
@@ -0,0 +1,52 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const invalidationChannel = "invalidate"
+
+// PublishInvalidation tells every auth-improved replica to drop its local
+// copy of username. The message carries KeyFor(username), so with key
+// hashing enabled subscribers learn no usernames.
+func (r *Redis) PublishInvalidation(ctx context.Context, username string) error {
+	return r.client.Publish(ctx, r.internalKey(invalidationChannel), r.KeyFor(username)).Err()
+}
+
+// SubscribeInvalidations calls onInvalidate with the KeyFor name of every
+// invalidated user until ctx is done. Messages published while the subscription is down are
+// lost, so onReset is called every time the subscription is (re)established
+// to let the caller drop everything it holds.
+func (r *Redis) SubscribeInvalidations(ctx context.Context, onInvalidate func(name string), onReset func()) {
+	pubsub := r.client.Subscribe(ctx, r.internalKey(invalidationChannel))
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Invalidation subscription error", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				onReset()
+			}
+		case *redis.Message:
+			onInvalidate(m.Payload)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"time"
 
 	"substack-auth/pkg/config"
@@ -11,21 +12,36 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// Nil is returned by Get when the key does not exist.
+const Nil = redis.Nil
+
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
 type Redis struct {
-	client *redis.Client
-	prefix string
-	ttl    time.Duration
+	client  redis.UniversalClient
+	prefix  string
+	ttl     time.Duration
+	softTTL time.Duration
+	jitter  time.Duration
+	layout  string
+	buckets int
+
+	keySecret []byte
 }
 
 func New(cfg *config.Config) (*Redis, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
-		Password: cfg.Redis.Password,
-		DB:       cfg.Redis.DB,
-	})
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx := context.Background()
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to redis: %w", err)
 	}
 
@@ -35,34 +51,202 @@ func New(cfg *config.Config) (*Redis, error) {
 		return nil, fmt.Errorf("failed to parse Redis TTL: %w", err)
 	}
 
-	slog.Info("Connected to Redis", "host", cfg.Redis.Host, "port", cfg.Redis.Port, "prefix", cfg.Redis.Prefix, "ttl", ttl)
+	softTTL, err := time.ParseDuration(cfg.Redis.SoftTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis soft TTL: %w", err)
+	}
+	// A soft TTL of zero turns soft expiry off, and one at or past the hard
+	// TTL could never fire.
+	if softTTL < 0 || softTTL >= ttl {
+		softTTL = 0
+	}
+
+	jitter, err := time.ParseDuration(cfg.Redis.TTLJitter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis TTL jitter: %w", err)
+	}
+
+	switch cfg.Redis.Layout {
+	case LayoutString:
+	case LayoutHash:
+		if cfg.Redis.Buckets <= 0 {
+			return nil, fmt.Errorf("REDIS_BUCKETS must be positive for the hash layout")
+		}
+	default:
+		return nil, fmt.Errorf("unknown Redis layout %q", cfg.Redis.Layout)
+	}
+
+	slog.Info("Connected to Redis", "mode", cfg.Redis.Mode, "host", cfg.Redis.Host, "port", cfg.Redis.Port, "addrs", cfg.Redis.Addrs,
+		"prefix", cfg.Redis.Prefix, "ttl", ttl, "soft_ttl", softTTL, "ttl_jitter", jitter, "layout", cfg.Redis.Layout, "buckets", cfg.Redis.Buckets,
+		"key_hashing", cfg.Redis.KeyHashing)
+
+	r := &Redis{
+		client:  client,
+		prefix:  cfg.Redis.Prefix,
+		ttl:     ttl,
+		softTTL: softTTL,
+		jitter:  jitter,
+		layout:  cfg.Redis.Layout,
+		buckets: cfg.Redis.Buckets,
+	}
+
+	if cfg.Redis.KeyHashing {
+		if err := checkKeySecret(cfg.Redis.KeyHashSecret); err != nil {
+			return nil, err
+		}
+		r.keySecret = []byte(cfg.Redis.KeyHashSecret)
+	}
 
-	return &Redis{client: client, prefix: cfg.Redis.Prefix, ttl: ttl}, nil
+	return r, nil
+}
+
+// newClient builds the client for the configured deployment mode. In cluster
+// mode pipelines are split per node by go-redis, so batched writes whose keys
+// span slots stay correct; multi-key transactions must keep their keys in a
+// single slot with a hash tag.
+func newClient(cfg *config.Config) (redis.UniversalClient, error) {
+	switch cfg.Redis.Mode {
+	case ModeStandalone:
+		return redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		}), nil
+	case ModeSentinel:
+		if cfg.Redis.MasterName == "" || len(cfg.Redis.Addrs) == 0 {
+			return nil, fmt.Errorf("sentinel mode requires REDIS_MASTER_NAME and REDIS_ADDRS")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.Redis.MasterName,
+			SentinelAddrs:    cfg.Redis.Addrs,
+			SentinelPassword: cfg.Redis.SentinelPassword,
+			Password:         cfg.Redis.Password,
+			DB:               cfg.Redis.DB,
+		}), nil
+	case ModeCluster:
+		if len(cfg.Redis.Addrs) == 0 {
+			return nil, fmt.Errorf("cluster mode requires REDIS_ADDRS")
+		}
+		if cfg.Redis.DB != 0 {
+			return nil, fmt.Errorf("cluster mode only supports REDIS_DB=0")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.Redis.Addrs,
+			Password: cfg.Redis.Password,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", cfg.Redis.Mode)
+	}
 }
 
 func (r *Redis) Set(ctx context.Context, key, value string) error {
+	key = r.KeyFor(key)
+	if r.layout == LayoutHash {
+		pipe := r.client.Pipeline()
+		r.hashSet(ctx, pipe, key, value, map[string]bool{})
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+
 	prefixedKey := r.prefix + key
-	return r.client.Set(ctx, prefixedKey, value, r.ttl).Err()
+	return r.client.Set(ctx, prefixedKey, value, r.expiry()).Err()
 }
 
 func (r *Redis) Get(ctx context.Context, key string) (string, error) {
+	key = r.KeyFor(key)
+	if r.layout == LayoutHash {
+		return r.hashGet(ctx, key)
+	}
+
 	prefixedKey := r.prefix + key
 	return r.client.Get(ctx, prefixedKey).Result()
 }
 
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	key = r.KeyFor(key)
+	if r.layout == LayoutHash {
+		return r.hashDel(ctx, key)
+	}
+
+	prefixedKey := r.prefix + key
+	return r.client.Del(ctx, prefixedKey).Err()
+}
+
+func (r *Redis) DeleteBatch(ctx context.Context, keys []string) error {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = r.KeyFor(key)
+	}
+	return r.DeleteNames(ctx, names)
+}
+
+// DeleteNames deletes entries by their stored name, as reported by ScanKeys,
+// for callers that cannot map a pseudonymous name back to a username.
+func (r *Redis) DeleteNames(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	current := r.generation(time.Now())
+	return r.writeFenced(ctx, func(pipe redis.Pipeliner) {
+		for _, name := range names {
+			if r.layout == LayoutHash {
+				pipe.HDel(ctx, r.bucketKey(current, name), name)
+				pipe.HDel(ctx, r.bucketKey(current-1, name), name)
+				continue
+			}
+			pipe.Del(ctx, r.prefix+name)
+		}
+	})
+}
+
 func (r *Redis) SetBatch(ctx context.Context, data map[string]string) error {
 	if len(data) == 0 {
 		return nil
 	}
 
-	pipe := r.client.Pipeline()
-	for key, value := range data {
-		prefixedKey := r.prefix + key
-		pipe.Set(ctx, prefixedKey, value, r.ttl)
+	return r.writeFenced(ctx, func(pipe redis.Pipeliner) {
+		touched := make(map[string]bool)
+		for key, value := range data {
+			key = r.KeyFor(key)
+			if r.layout == LayoutHash {
+				r.hashSet(ctx, pipe, key, value, touched)
+				continue
+			}
+
+			prefixedKey := r.prefix + key
+			pipe.Set(ctx, prefixedKey, value, r.expiry())
+		}
+	})
+}
+
+// SoftExpiry returns when an entry written now should be considered stale
+// and refreshed in the background. Like the hard TTL it is jittered so
+// entries written in the same run do not all go stale in the same second.
+// With soft expiry off it returns the zero time: the entry never goes stale.
+func (r *Redis) SoftExpiry() time.Time {
+	if r.softTTL == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(r.softTTL + r.randomJitter())
+}
+
+// expiry is the hard TTL for a key written now.
+func (r *Redis) expiry() time.Duration {
+	return r.ttl + r.randomJitter()
+}
+
+func (r *Redis) randomJitter() time.Duration {
+	if r.jitter <= 0 {
+		return 0
 	}
+	return rand.N(r.jitter)
+}
 
-	_, err := pipe.Exec(ctx)
-	return err
+// internalKey namespaces bookkeeping keys outside the user keyspace so they
+// can never collide with a username and are not matched by "<prefix>*".
+func (r *Redis) internalKey(name string) string {
+	return "_" + r.prefix + name
 }
 
 func (r *Redis) Close() error {
@@ -0,0 +1,31 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+
+	"substack-auth/pkg/config"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedis connects to a fresh miniredis with the default configuration,
+// adjusted by configure when it is not nil.
+func newTestRedis(t *testing.T, configure func(*config.Config)) (*miniredis.Miniredis, *Redis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	cfg := config.Load()
+	cfg.Redis.Host = mr.Host()
+	cfg.Redis.Port, _ = strconv.Atoi(mr.Port())
+	if configure != nil {
+		configure(cfg)
+	}
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return mr, r
+}
@@ -0,0 +1,35 @@
+// Package redistest connects a Redis client to an in-memory miniredis for
+// tests in other packages.
+package redistest
+
+import (
+	"strconv"
+	"testing"
+
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/redis"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// New returns a fresh miniredis and a client for it built from the default
+// configuration, adjusted by configure when it is not nil. Both are closed
+// when the test ends.
+func New(t testing.TB, configure func(*config.Config)) (*miniredis.Miniredis, *redis.Redis, *config.Config) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	cfg := config.Load()
+	cfg.Redis.Host = mr.Host()
+	cfg.Redis.Port, _ = strconv.Atoi(mr.Port())
+	if configure != nil {
+		configure(cfg)
+	}
+
+	r, err := redis.New(cfg)
+	if err != nil {
+		t.Fatalf("redis.New: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return mr, r, cfg
+}
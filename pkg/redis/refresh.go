@@ -0,0 +1,71 @@
+package redis
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrRefreshQueueFull is returned by EnqueueRefresh when the queue already
+// holds its maximum number of users.
+var ErrRefreshQueueFull = errors.New("refresh queue full")
+
+// The refresh queue is a list of user ids plus a set of the same ids for
+// deduplication. Ids rather than usernames keep plaintext usernames out of
+// Redis when key hashing is on. Both keys share a hash tag so the scripts
+// below can touch them together in cluster mode.
+func (r *Redis) refreshKeys() []string {
+	queue := r.internalKey("refresh:{queue}")
+	return []string{queue, queue + ":pending"}
+}
+
+// enqueueRefreshScript appends a user id unless it is already queued or the
+// queue is at its limit. It returns 1 when queued, 0 for a duplicate and -1
+// when full.
+var enqueueRefreshScript = redis.NewScript(`
+if redis.call("SISMEMBER", KEYS[2], ARGV[1]) == 1 then
+	return 0
+end
+if redis.call("LLEN", KEYS[1]) >= tonumber(ARGV[2]) then
+	return -1
+end
+redis.call("SADD", KEYS[2], ARGV[1])
+redis.call("RPUSH", KEYS[1], ARGV[1])
+return 1
+`)
+
+// popRefreshScript takes up to ARGV[1] ids off the queue and forgets them in
+// the same step, so an id is never left marked as queued.
+var popRefreshScript = redis.NewScript(`
+local names = redis.call("LPOP", KEYS[1], ARGV[1])
+if not names or #names == 0 then
+	return {}
+end
+redis.call("SREM", KEYS[2], unpack(names))
+return names
+`)
+
+// EnqueueRefresh asks the precache worker to cache the user with userID. It
+// reports whether the id was added; false means it was already waiting.
+func (r *Redis) EnqueueRefresh(ctx context.Context, userID int64, limit int) (bool, error) {
+	result, err := enqueueRefreshScript.Run(ctx, r.client, r.refreshKeys(), userID, limit).Int()
+	if err != nil {
+		return false, err
+	}
+	if result < 0 {
+		return false, ErrRefreshQueueFull
+	}
+	return result == 1, nil
+}
+
+// PopRefreshes removes and returns up to count queued user ids in the order
+// they were enqueued.
+func (r *Redis) PopRefreshes(ctx context.Context, count int) ([]int64, error) {
+	return popRefreshScript.Run(ctx, r.client, r.refreshKeys(), count).Int64Slice()
+}
+
+// RefreshQueueLen returns the number of users waiting in the queue.
+func (r *Redis) RefreshQueueLen(ctx context.Context) (int64, error) {
+	return r.client.LLen(ctx, r.refreshKeys()[0]).Result()
+}
@@ -0,0 +1,76 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestEnqueueRefresh(t *testing.T) {
+	_, r := newTestRedis(t, nil)
+	ctx := context.Background()
+
+	for _, id := range []int64{1, 2} {
+		if queued, err := r.EnqueueRefresh(ctx, id, 3); err != nil || !queued {
+			t.Fatalf("EnqueueRefresh(%d) = %v, %v; want queued", id, queued, err)
+		}
+	}
+	if queued, err := r.EnqueueRefresh(ctx, 1, 3); err != nil || queued {
+		t.Errorf("EnqueueRefresh of a waiting id = %v, %v; want a duplicate", queued, err)
+	}
+	if queued, err := r.EnqueueRefresh(ctx, 3, 3); err != nil || !queued {
+		t.Fatalf("EnqueueRefresh(3) = %v, %v; want queued", queued, err)
+	}
+	if _, err := r.EnqueueRefresh(ctx, 4, 3); !errors.Is(err, ErrRefreshQueueFull) {
+		t.Errorf("EnqueueRefresh on a full queue err = %v, want %v", err, ErrRefreshQueueFull)
+	}
+	// A waiting id is reported as such even when the queue is full.
+	if queued, err := r.EnqueueRefresh(ctx, 2, 3); err != nil || queued {
+		t.Errorf("EnqueueRefresh of a waiting id on a full queue = %v, %v; want a duplicate", queued, err)
+	}
+
+	if n, _ := r.RefreshQueueLen(ctx); n != 3 {
+		t.Errorf("RefreshQueueLen = %d, want 3", n)
+	}
+}
+
+func TestPopRefreshes(t *testing.T) {
+	_, r := newTestRedis(t, nil)
+	ctx := context.Background()
+
+	for _, id := range []int64{5, 3, 8} {
+		if _, err := r.EnqueueRefresh(ctx, id, 10); err != nil {
+			t.Fatalf("EnqueueRefresh(%d): %v", id, err)
+		}
+	}
+
+	ids, err := r.PopRefreshes(ctx, 2)
+	if err != nil {
+		t.Fatalf("PopRefreshes: %v", err)
+	}
+	if !slices.Equal(ids, []int64{5, 3}) {
+		t.Errorf("PopRefreshes = %v, want [5 3] in enqueue order", ids)
+	}
+
+	// Popped ids are forgotten, so they can be queued again.
+	if queued, err := r.EnqueueRefresh(ctx, 5, 10); err != nil || !queued {
+		t.Errorf("EnqueueRefresh of a popped id = %v, %v; want queued", queued, err)
+	}
+	if n, _ := r.client.SCard(ctx, r.refreshKeys()[1]).Result(); n != 2 {
+		t.Errorf("pending set holds %d ids, want 2", n)
+	}
+
+	ids, err = r.PopRefreshes(ctx, 10)
+	if err != nil {
+		t.Fatalf("PopRefreshes: %v", err)
+	}
+	if !slices.Equal(ids, []int64{8, 5}) {
+		t.Errorf("PopRefreshes = %v, want [8 5]", ids)
+	}
+
+	ids, err = r.PopRefreshes(ctx, 10)
+	if err != nil || len(ids) != 0 {
+		t.Errorf("PopRefreshes on an empty queue = %v, %v; want none", ids, err)
+	}
+}
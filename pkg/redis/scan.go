@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const scanCount = 1000
+
+// GetBatch fetches many keys in one pipeline. Keys that are not cached are
+// absent from the result.
+func (r *Redis) GetBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	names := make(map[string]string, len(keys))
+	for _, key := range keys {
+		names[r.KeyFor(key)] = key
+	}
+
+	values, err := r.GetNames(ctx, slices.Collect(maps.Keys(names)))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(values))
+	for name, value := range values {
+		result[names[name]] = value
+	}
+	return result, nil
+}
+
+// GetNames is GetBatch for stored entry names as reported by ScanKeys.
+func (r *Redis) GetNames(ctx context.Context, names []string) (map[string]string, error) {
+	result := make(map[string]string, len(names))
+	if len(names) == 0 {
+		return result, nil
+	}
+
+	pipe := r.client.Pipeline()
+	current := r.generation(time.Now())
+	cmds := make(map[string][]*redis.StringCmd, len(names))
+	for _, name := range names {
+		if r.layout == LayoutHash {
+			cmds[name] = []*redis.StringCmd{
+				pipe.HGet(ctx, r.bucketKey(current, name), name),
+				pipe.HGet(ctx, r.bucketKey(current-1, name), name),
+			}
+			continue
+		}
+		cmds[name] = []*redis.StringCmd{pipe.Get(ctx, r.prefix+name)}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for name, nameCmds := range cmds {
+		for _, cmd := range nameCmds {
+			if value, err := cmd.Result(); err == nil {
+				result[name] = value
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// ScanKeys calls fn with batches of stored entry names until every cached
+// entry has been visited. Names are usernames, or their KeyFor pseudonyms
+// when key hashing is enabled. It uses SCAN, so it does not block Redis, and
+// in cluster mode it walks every master. With the hash layout a name may be
+// reported once per live generation.
+func (r *Redis) ScanKeys(ctx context.Context, fn func(names []string) error) error {
+	var mu sync.Mutex
+	report := func(names []string) error {
+		if len(names) == 0 {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return fn(names)
+	}
+
+	return r.forEachNode(ctx, func(ctx context.Context, client redis.Cmdable) error {
+		if r.layout == LayoutHash {
+			return r.scanBuckets(ctx, client, report)
+		}
+		return r.scanStrings(ctx, client, report)
+	})
+}
+
+func (r *Redis) scanStrings(ctx context.Context, client redis.Cmdable, report func([]string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, r.prefix+"*", scanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(keys))
+		for _, key := range keys {
+			names = append(names, strings.TrimPrefix(key, r.prefix))
+		}
+		if err := report(names); err != nil {
+			return err
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (r *Redis) scanBuckets(ctx context.Context, client redis.Cmdable, report func([]string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, r.internalKey("bucket:*"), scanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			fields, err := client.HKeys(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if err := report(fields); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// forEachNode runs fn against every node holding data: each master in
+// cluster mode, otherwise the single client.
+func (r *Redis) forEachNode(ctx context.Context, fn func(ctx context.Context, client redis.Cmdable) error) error {
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return fn(ctx, client)
+		})
+	}
+	return fn(ctx, r.client)
+}
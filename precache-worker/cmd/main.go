@@ -2,29 +2,45 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"substack-auth/pkg/codec"
 	"substack-auth/pkg/config"
 	"substack-auth/pkg/database"
 	"substack-auth/pkg/redis"
+	"substack-auth/precache-worker/internal/handler"
 	"substack-auth/precache-worker/internal/worker"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/robfig/cron/v3"
 )
 
 func main() {
+	history := flag.Int("history", 0, "print the last N precache runs as JSON and exit")
+	restart := flag.Bool("restart", false, "discard the checkpoint of an interrupted run and sweep from the first user")
+	dryRun := flag.Bool("dry-run", false, "compare a full sweep against Redis, print what it would change as JSON and exit without writing")
+	flag.Parse()
+
 	cfg := config.Load()
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	// Keep stdout clean for the -history and -dry-run JSON reports.
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 	slog.SetDefault(logger)
 
-	if !cfg.Features.PrecacheEnabled {
+	if *history == 0 && !*dryRun && !cfg.Features.PrecacheEnabled {
 		logger.Info("Precache worker is disabled, exiting")
 		return
 	}
@@ -43,33 +59,224 @@ func main() {
 	}
 	defer redisClient.Close()
 
-	precacheWorker := worker.New(db, redisClient, cfg)
+	userCodec, err := codec.New(cfg)
+	if err != nil {
+		logger.Error("Failed to initialize cache codec", "error", err)
+		os.Exit(1)
+	}
+
+	if size, err := codec.SampleSize(userCodec); err == nil {
+		redisClient.CheckListpack(context.Background(), size)
+	}
 
-	// Run immediately first
-	logger.Info("Running precache worker immediately...")
-	if err := precacheWorker.Run(context.Background()); err != nil {
-		logger.Error("Initial precache worker run failed", "error", err)
-	} else {
-		logger.Info("Initial precache worker run completed successfully")
+	precacheWorker, err := worker.New(db, redisClient, userCodec, cfg)
+	if err != nil {
+		logger.Error("Invalid precache configuration", "error", err)
+		os.Exit(1)
 	}
 
-	// Then schedule to run every 5 minutes
-	c := cron.New(cron.WithSeconds())
-	entryID := c.Schedule(cron.Every(5*time.Minute), cron.FuncJob(func() {
-		if err := precacheWorker.Run(context.Background()); err != nil {
-			logger.Error("Precache worker failed", "error", err)
+	if *history > 0 {
+		records, err := precacheWorker.History(context.Background(), *history)
+		if err != nil {
+			logger.Error("Failed to read run history", "error", err)
+			os.Exit(1)
 		}
-	}))
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			logger.Error("Failed to print run history", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *dryRun {
+		report, err := precacheWorker.DryRun(context.Background())
+		if err != nil {
+			logger.Error("Precache dry run failed", "error", err)
+			os.Exit(1)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			logger.Error("Failed to print dry run report", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *restart {
+		if err := precacheWorker.ResetCheckpoint(context.Background()); err != nil {
+			logger.Error("Failed to discard precache checkpoint", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Discarded precache checkpoint, next run starts from the first user")
+	}
+
+	if err := precacheWorker.CheckSchema(context.Background()); err != nil {
+		logger.Error("Database schema does not support the precache mode", "mode", cfg.Precache.Mode, "error", err)
+		os.Exit(1)
+	}
 
-	logger.Info("Precache worker scheduled to run every 5 minutes", "entry_id", entryID)
+	// Without a token anyone who can reach the admin API can cancel runs
+	// and pause the schedule, so it may only listen on loopback.
+	if cfg.Service.PrecacheAdminPort > 0 && cfg.Service.PrecacheAdminToken == "" && !isLoopback(cfg.Service.PrecacheAdminHost) {
+		logger.Error("Refusing to expose the precache admin API without PRECACHE_ADMIN_TOKEN", "host", cfg.Service.PrecacheAdminHost)
+		os.Exit(1)
+	}
+
+	campaignCtx, stopCampaign := context.WithCancel(context.Background())
+	campaignDone := make(chan struct{})
+	go func() {
+		defer close(campaignDone)
+		precacheWorker.Campaign(campaignCtx)
+	}()
+
+	c := cron.New(cron.WithParser(cron.NewParser(
+		cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+	)))
+
+	tailCtx, stopTail := context.WithCancel(context.Background())
+	tailDone := make(chan struct{})
+	tailFailed := make(chan error, 1)
+
+	// In cdc mode the schedule makes the binlog tail sweep, so entries of
+	// users nobody changes are rewritten before REDIS_TTL expires them.
+	scheduled := func() { runPrecache(precacheWorker, "schedule") }
+	if cfg.Precache.Mode == worker.ModeCDC {
+		scheduled = precacheWorker.Resync
+	}
+
+	entryID, err := c.AddFunc(cfg.Precache.CronSchedule, func() {
+		if precacheWorker.Paused() {
+			logger.Debug("Skipping scheduled precache run, schedule is paused")
+			return
+		}
+		scheduled()
+	})
+	if err != nil {
+		logger.Error("Invalid CRON_SCHEDULE", "schedule", cfg.Precache.CronSchedule, "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("Precache worker scheduled", "schedule", cfg.Precache.CronSchedule, "mode", cfg.Precache.Mode, "overlap_policy", cfg.Precache.OverlapPolicy, "entry_id", entryID)
 
 	c.Start()
 
+	if cfg.Precache.Mode == worker.ModeCDC {
+		// The tail sweeps on its own when it has no position to resume from.
+		go func() {
+			defer close(tailDone)
+			if err := precacheWorker.Tail(tailCtx); err != nil {
+				tailFailed <- err
+			}
+		}()
+	} else {
+		close(tailDone)
+
+		// Run immediately first; scheduled runs overlapping it follow the overlap policy
+		logger.Info("Running precache worker immediately...")
+		go runPrecache(precacheWorker, "startup")
+	}
+
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	refreshDone := make(chan struct{})
+	if cfg.Features.RefreshQueueEnabled {
+		go func() {
+			defer close(refreshDone)
+			precacheWorker.ConsumeRefreshes(refreshCtx)
+		}()
+	} else {
+		close(refreshDone)
+	}
+
+	var adminServer *http.Server
+	if cfg.Service.PrecacheAdminPort > 0 {
+		adminHandler := handler.NewAdminHandler(precacheWorker)
+
+		r := chi.NewRouter()
+		r.Use(middleware.Logger)
+		r.Use(middleware.Recoverer)
+		r.Use(middleware.RequestID)
+		r.Use(handler.RequireToken(cfg.Service.PrecacheAdminToken))
+
+		r.Get("/status", adminHandler.Status)
+		r.Post("/runs", adminHandler.Trigger)
+		r.Get("/runs", adminHandler.History)
+		r.Get("/runs/current", adminHandler.Current)
+		r.Post("/runs/current/cancel", adminHandler.Cancel)
+		r.Post("/schedule/pause", adminHandler.Pause)
+		r.Post("/schedule/resume", adminHandler.Resume)
+
+		adminServer = &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", cfg.Service.PrecacheAdminHost, cfg.Service.PrecacheAdminPort),
+			Handler: r,
+		}
+
+		go func() {
+			logger.Info("Starting precache admin API", "addr", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Admin server error", "error", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+
+	exitCode := 0
+	select {
+	case <-quit:
+	case err := <-tailFailed:
+		logger.Error("Binlog tail cannot continue", "error", err)
+		exitCode = 1
+	}
 
 	logger.Info("Shutting down precache worker...")
-	c.Stop()
+	if adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logger.Error("Admin server forced to shutdown", "error", err)
+		}
+		cancel()
+	}
+	// Stop scheduling, then cancel the in-flight run; it keeps its
+	// checkpoint so the next start resumes it.
+	cronStopped := c.Stop()
+	precacheWorker.Shutdown()
+	<-cronStopped.Done()
+	stopTail()
+	<-tailDone
+	stopRefresh()
+	<-refreshDone
+	stopCampaign()
+	<-campaignDone
 	logger.Info("Precache worker stopped")
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// isLoopback reports whether host only accepts local connections. An empty
+// host listens on every interface.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func runPrecache(w *worker.Worker, trigger string) {
+	record, err := w.Execute(context.Background(), trigger)
+	switch {
+	case errors.Is(err, worker.ErrRunInProgress):
+		return
+	case errors.Is(err, worker.ErrNotLeader):
+		slog.Debug("Skipping precache run, another replica is the leader", "trigger", trigger)
+	case err != nil:
+		slog.Error("Precache worker run failed", "trigger", trigger, "error", err)
+	default:
+		slog.Info("Precache worker run completed", "trigger", trigger, "run_id", record.ID, "processed", record.Processed, "duration", record.Duration)
+	}
 }
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"substack-auth/precache-worker/internal/worker"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 1000
+)
+
+type AdminHandler struct {
+	worker Worker
+}
+
+type Worker interface {
+	Trigger(trigger string, restart bool) error
+	Cancel() bool
+	Progress() *worker.Progress
+	History(ctx context.Context, limit int) ([]worker.RunRecord, error)
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+// Status is the response of GET /status.
+type Status struct {
+	Running  bool             `json:"running"`
+	Paused   bool             `json:"paused"`
+	Progress *worker.Progress `json:"progress,omitempty"`
+}
+
+func NewAdminHandler(worker Worker) *AdminHandler {
+	return &AdminHandler{worker: worker}
+}
+
+// RequireToken rejects requests without "Authorization: Bearer <token>".
+// An empty token leaves the admin API open, for local use only.
+func RequireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (h *AdminHandler) Status(w http.ResponseWriter, r *http.Request) {
+	progress := h.worker.Progress()
+	writeJSON(w, http.StatusOK, Status{
+		Running:  progress != nil,
+		Paused:   h.worker.Paused(),
+		Progress: progress,
+	})
+}
+
+func (h *AdminHandler) Trigger(w http.ResponseWriter, r *http.Request) {
+	restart := r.URL.Query().Get("restart") == "true"
+
+	err := h.worker.Trigger("admin", restart)
+	if errors.Is(err, worker.ErrRunInProgress) {
+		http.Error(w, "A precache run is already in progress", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, worker.ErrShuttingDown) {
+		http.Error(w, "Precache worker is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to trigger precache run", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+func (h *AdminHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	if !h.worker.Cancel() {
+		http.Error(w, "No precache run in progress", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "cancelling"})
+}
+
+func (h *AdminHandler) Current(w http.ResponseWriter, r *http.Request) {
+	progress := h.worker.Progress()
+	if progress == nil {
+		http.Error(w, "No precache run in progress", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, progress)
+}
+
+func (h *AdminHandler) History(w http.ResponseWriter, r *http.Request) {
+	limit := defaultHistoryLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records, err := h.worker.History(r.Context(), limit)
+	if err != nil {
+		slog.Error("Failed to read run history", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (h *AdminHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	h.worker.Pause()
+	slog.Info("Precache schedule paused")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (h *AdminHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	h.worker.Resume()
+	slog.Info("Precache schedule resumed")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
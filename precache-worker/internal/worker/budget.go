@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"substack-auth/pkg/models"
+	"substack-auth/pkg/redis"
+)
+
+const (
+	BudgetStop     = "stop"
+	BudgetExisting = "existing"
+
+	// budgetCheckInterval limits INFO calls when several writers ask at
+	// once; batches finishing within it share one reading.
+	budgetCheckInterval = 250 * time.Millisecond
+)
+
+// memoryBudget keeps a run within PRECACHE_MEMORY_BUDGET of Redis
+// maxmemory. Once usage crosses the budget the run stays degraded until it
+// ends: with the stop policy it writes nothing more, with the existing
+// policy it only refreshes users that are already cached, which does not
+// grow the dataset.
+type memoryBudget struct {
+	redis  *redis.Redis
+	limit  float64
+	policy string
+	// memory reads the current usage; it is redis.Memory outside tests.
+	memory func(context.Context) (redis.MemoryUsage, error)
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	exceeded  bool
+}
+
+func newMemoryBudget(redis *redis.Redis, limit float64, policy string) *memoryBudget {
+	return &memoryBudget{redis: redis, limit: limit, policy: policy, memory: redis.Memory}
+}
+
+// admit returns the users of a batch that fit the budget.
+func (b *memoryBudget) admit(ctx context.Context, users []models.User) ([]models.User, error) {
+	if b == nil || b.limit <= 0 {
+		return users, nil
+	}
+
+	exceeded, err := b.check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exceeded {
+		return users, nil
+	}
+
+	if b.policy != BudgetExisting {
+		return nil, nil
+	}
+
+	usernames := make([]string, len(users))
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+	cached, err := b.redis.CachedNames(ctx, usernames)
+	if err != nil {
+		return nil, fmt.Errorf("check cached users: %w", err)
+	}
+
+	admitted := users[:0:0]
+	for _, user := range users {
+		if cached[user.Username] {
+			admitted = append(admitted, user)
+		}
+	}
+	return admitted, nil
+}
+
+func (b *memoryBudget) check(ctx context.Context) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.exceeded || time.Since(b.checkedAt) < budgetCheckInterval {
+		return b.exceeded, nil
+	}
+
+	usage, err := b.memory(ctx)
+	if err != nil {
+		return false, fmt.Errorf("read redis memory usage: %w", err)
+	}
+	b.checkedAt = time.Now()
+
+	if usage.Max > 0 && usage.Fraction() >= b.limit {
+		b.exceeded = true
+		slog.Warn("Redis memory budget exceeded, precaching degraded for the rest of the run",
+			"used_memory", usage.Used, "maxmemory", usage.Max, "budget", b.limit, "policy", b.policy)
+	}
+	return b.exceeded, nil
+}
+
+// admit applies the run's memory budget to a batch and counts the users it
+// leaves out.
+func (w *Worker) admit(ctx context.Context, users []models.User) ([]models.User, error) {
+	admitted, err := w.budget.admit(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+
+	if skipped := len(users) - len(admitted); skipped > 0 {
+		w.recordSkipped(skipped)
+		slog.Debug("Skipped users over memory budget", "count", skipped)
+	}
+	return admitted, nil
+}
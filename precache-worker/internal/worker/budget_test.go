@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/models"
+	"substack-auth/pkg/redis"
+)
+
+// fakeMemory reports used bytes out of a 100 byte maxmemory, since
+// miniredis does not answer INFO memory.
+type fakeMemory struct {
+	used  atomic.Int64
+	reads atomic.Int64
+}
+
+func (m *fakeMemory) read(context.Context) (redis.MemoryUsage, error) {
+	m.reads.Add(1)
+	return redis.MemoryUsage{Used: m.used.Load(), Max: 100}, nil
+}
+
+func newTestBudget(env *testEnv, policy string, used int64) (*memoryBudget, *fakeMemory) {
+	memory := &fakeMemory{}
+	memory.used.Store(used)
+
+	b := newMemoryBudget(env.redis, 0.8, policy)
+	b.memory = memory.read
+	return b, memory
+}
+
+func usernames(users []models.User) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return names
+}
+
+func TestMemoryBudgetPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		used   int64
+		want   []string
+	}{
+		{"under budget", BudgetStop, 50, []string{"cached@katakode.com", "new@katakode.com"}},
+		{"stop", BudgetStop, 90, nil},
+		{"existing", BudgetExisting, 90, []string{"cached@katakode.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestWorker(t, nil)
+			ctx := context.Background()
+			if err := env.redis.Set(ctx, "cached@katakode.com", "entry"); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			b, _ := newTestBudget(env, tt.policy, tt.used)
+
+			users := []models.User{{ID: 1, Username: "cached@katakode.com"}, {ID: 2, Username: "new@katakode.com"}}
+			admitted, err := b.admit(ctx, users)
+			if err != nil {
+				t.Fatalf("admit: %v", err)
+			}
+			if got := usernames(admitted); !slices.Equal(got, tt.want) {
+				t.Errorf("admitted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBudgetStaysExceeded(t *testing.T) {
+	env := newTestWorker(t, nil)
+	ctx := context.Background()
+	b, memory := newTestBudget(env, BudgetStop, 50)
+	users := []models.User{{ID: 1, Username: "test@katakode.com"}}
+
+	if admitted, _ := b.admit(ctx, users); len(admitted) != 1 {
+		t.Fatalf("admitted %d users under budget, want 1", len(admitted))
+	}
+
+	// Batches within the check interval share the last reading.
+	memory.used.Store(90)
+	if admitted, _ := b.admit(ctx, users); len(admitted) != 1 {
+		t.Errorf("admitted %d users on a cached reading, want 1", len(admitted))
+	}
+	if n := memory.reads.Load(); n != 1 {
+		t.Errorf("memory read %d times within the check interval, want 1", n)
+	}
+
+	b.checkedAt = time.Now().Add(-budgetCheckInterval)
+	if admitted, _ := b.admit(ctx, users); len(admitted) != 0 {
+		t.Errorf("admitted %d users over budget, want 0", len(admitted))
+	}
+
+	// Usage falling again, e.g. through evictions, does not resume writes.
+	memory.used.Store(10)
+	b.checkedAt = time.Now().Add(-budgetCheckInterval)
+	if admitted, _ := b.admit(ctx, users); len(admitted) != 0 {
+		t.Errorf("admitted %d users after the budget was exceeded, want 0", len(admitted))
+	}
+}
+
+func TestMemoryBudgetWithoutMaxmemory(t *testing.T) {
+	env := newTestWorker(t, nil)
+	b := newMemoryBudget(env.redis, 0.8, BudgetStop)
+	b.memory = func(context.Context) (redis.MemoryUsage, error) {
+		return redis.MemoryUsage{Used: 1 << 30}, nil
+	}
+
+	admitted, err := b.admit(context.Background(), []models.User{{ID: 1, Username: "test@katakode.com"}})
+	if err != nil || len(admitted) != 1 {
+		t.Errorf("admit = %d users, %v; want the user admitted without a maxmemory", len(admitted), err)
+	}
+}
+
+func TestSweepOverBudget(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantRefresh bool
+	}{
+		{BudgetStop, false},
+		{BudgetExisting, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			env := newTestWorker(t, func(cfg *config.Config) {
+				cfg.Precache.BatchSize = 2
+			})
+			ctx := context.Background()
+
+			existing := env.db.AddUser("existing@katakode.com", "$2a$10$hash")
+			for _, username := range []string{"a@katakode.com", "b@katakode.com", "c@katakode.com"} {
+				env.db.AddUser(username, "$2a$10$hash")
+			}
+			if err := env.redis.Set(ctx, existing.Username, "stale"); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+
+			env.worker.budget, _ = newTestBudget(env, tt.policy, 90)
+			env.worker.setProgress(&Progress{RunID: "1", StartedAt: time.Now()}, nil)
+			if err := env.worker.sweepAll(ctx); err != nil {
+				t.Fatalf("sweepAll over budget: %v", err)
+			}
+
+			wantSkipped := 3
+			if !tt.wantRefresh {
+				wantSkipped = 4
+			}
+			if got := env.worker.Progress().SkippedOverBudget; got != wantSkipped {
+				t.Errorf("skipped over budget = %d, want %d", got, wantSkipped)
+			}
+			for _, username := range []string{"a@katakode.com", "b@katakode.com", "c@katakode.com"} {
+				if data, _ := env.redis.Get(ctx, username); data != "" {
+					t.Errorf("%s cached over budget", username)
+				}
+			}
+
+			data, _ := env.redis.Get(ctx, existing.Username)
+			if refreshed := data != "stale"; refreshed != tt.wantRefresh {
+				t.Errorf("existing entry refreshed = %v, want %v", refreshed, tt.wantRefresh)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"substack-auth/pkg/binlog"
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/models"
+	"substack-auth/pkg/redis"
+)
+
+const (
+	ModeCDC = "cdc"
+
+	stateBinlogPosition = "binlog_position"
+
+	usersTable = "users"
+
+	// cdcRetryDelay is the pause before reconnecting after a stream error.
+	cdcRetryDelay = 5 * time.Second
+	// cdcCheckpointInterval bounds how often the binlog position is written
+	// back; a restart replays at most this much, which is harmless because
+	// applying a row image twice gives the same cache entry.
+	cdcCheckpointInterval = time.Second
+	cdcHeartbeat          = 10 * time.Second
+)
+
+// errResyncRequested ends a replication session so the next one starts
+// with a full sweep.
+var errResyncRequested = errors.New("resync requested")
+
+// Tail follows the MySQL binlog and applies every insert, update and delete
+// on the users table to the cache as its transaction commits. It resumes
+// from the checkpointed binlog position; when there is none, the server no
+// longer has it, or Resync was called, it records the current position and
+// runs a full sweep before tailing from there. Tail returns nil when ctx is
+// done, and an error when the server uses a binlog or authentication
+// feature the client does not support, as retrying cannot fix that.
+func (w *Worker) Tail(ctx context.Context) error {
+	slog.Info("Starting binlog tail", "server_id", w.cfg.CDC.ServerID)
+
+	for ctx.Err() == nil {
+		err := w.tail(ctx)
+
+		switch {
+		case ctx.Err() != nil:
+		case errors.Is(err, errResyncRequested):
+			slog.Info("Restarting binlog tail for a full sweep")
+		case errors.Is(err, binlog.ErrUnsupported):
+			return err
+		case errors.Is(err, ErrNotLeader):
+			sleep(ctx, w.cfg.Leader.LeaseTTL/3)
+		case errors.Is(err, ErrLeadershipLost), errors.Is(err, redis.ErrFenced):
+			slog.Warn("Stopped binlog tail after losing leadership")
+		case binlog.IsPositionLost(err):
+			slog.Warn("Checkpointed binlog position is gone, resynchronizing", "error", err)
+			if err := w.db.SetState(ctx, stateBinlogPosition, ""); err != nil {
+				slog.Error("Failed to clear binlog position", "error", err)
+				sleep(ctx, cdcRetryDelay)
+			}
+		default:
+			slog.Error("Binlog tail failed, retrying", "error", err, "retry_in", cdcRetryDelay)
+			sleep(ctx, cdcRetryDelay)
+		}
+	}
+
+	slog.Info("Binlog tail stopped")
+	return nil
+}
+
+// Resync asks the binlog tail to run a full sweep and then replay the binlog
+// from where the sweep started, which rewrites every entry and the Bloom
+// filter before REDIS_TTL expires them. Sweeping while the tail applies
+// changes could overwrite a newer row with the one the sweep read earlier,
+// so the tail stops for the sweep instead. Resync returns immediately; the
+// sweep runs on the tail's next session, once this replica leads.
+func (w *Worker) Resync() {
+	w.resyncRequested.Store(true)
+	select {
+	case w.resyncWake <- struct{}{}:
+	default:
+	}
+}
+
+// tail runs one replication session until it fails or ctx is done.
+func (w *Worker) tail(ctx context.Context) error {
+	var token int64
+	if w.elector != nil {
+		leadCtx, cancel, term, err := w.elector.lead(ctx)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		// Cache writes made under this context are dropped once a later
+		// tenure starts, even if the lease is lost mid-transaction.
+		ctx, token = w.redis.WithFence(leadCtx, leaseName, term), term
+	}
+
+	file, pos, checksum, err := w.db.BinlogStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("read binlog status: %w", err)
+	}
+
+	start, ok, err := w.loadPosition(ctx)
+	if err != nil {
+		return err
+	}
+	if requested := w.resyncRequested.Swap(false); !ok || requested {
+		// Capture the position before the sweep so changes made while it
+		// runs are replayed afterwards.
+		start = binlog.Position{File: file, Pos: pos}
+		if err := w.resync(ctx, start); err != nil {
+			if requested {
+				w.resyncRequested.Store(true)
+			}
+			return err
+		}
+	}
+
+	conn, err := binlog.Dial(ctx, binlog.Config{
+		Host:      w.cfg.DB.Host,
+		Port:      w.cfg.DB.Port,
+		User:      w.cfg.DB.User,
+		Password:  w.cfg.DB.Password,
+		ServerID:  uint32(w.cfg.CDC.ServerID),
+		Heartbeat: cdcHeartbeat,
+		Tables:    []string{w.cfg.DB.Name + "." + usersTable},
+	})
+	if err != nil {
+		return fmt.Errorf("connect to binlog: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Dump(start, checksum); err != nil {
+		return fmt.Errorf("start binlog dump at %s: %w", start, err)
+	}
+	slog.Info("Tailing binlog", "position", start.String(), "checksum", checksum)
+
+	s := &cdcSession{
+		worker:     w,
+		token:      token,
+		pending:    make(map[string]*models.User),
+		checkpoint: start,
+		savedAt:    time.Now(),
+	}
+	defer s.saveCheckpoint()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-w.resyncWake:
+			cancel(errResyncRequested)
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		event, err := conn.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+
+		if err := s.handle(ctx, event); err != nil {
+			return err
+		}
+	}
+}
+
+// resync runs a full sweep and, once it succeeds, checkpoints pos.
+func (w *Worker) resync(ctx context.Context, pos binlog.Position) error {
+	slog.Info("No binlog position to resume from, running full sweep", "position", pos.String())
+
+	if _, err := w.Execute(ctx, "cdc-resync"); err != nil {
+		return fmt.Errorf("full sweep before binlog tail: %w", err)
+	}
+	if err := w.db.SetState(ctx, stateBinlogPosition, pos.String()); err != nil {
+		return fmt.Errorf("save binlog position: %w", err)
+	}
+	return nil
+}
+
+func (w *Worker) loadPosition(ctx context.Context) (binlog.Position, bool, error) {
+	value, ok, err := w.db.State(ctx, stateBinlogPosition)
+	if err != nil {
+		return binlog.Position{}, false, fmt.Errorf("load binlog position: %w", err)
+	}
+	if !ok || value == "" {
+		return binlog.Position{}, false, nil
+	}
+
+	pos, err := binlog.ParsePosition(value)
+	if err != nil {
+		return binlog.Position{}, false, err
+	}
+	return pos, true, nil
+}
+
+// cdcSession holds the state of one replication session: the users table
+// layout and the changes of the transaction being read.
+type cdcSession struct {
+	worker *Worker
+	token  int64
+
+	// table is the last table map seen for users and columns its column
+	// names, in row image order.
+	table   *binlog.Table
+	columns []string
+
+	// pending maps each username touched by the open transaction to its
+	// final row, or nil if it was deleted.
+	pending map[string]*models.User
+
+	checkpoint binlog.Position
+	savedAt    time.Time
+	dirty      bool
+}
+
+func (s *cdcSession) handle(ctx context.Context, event *binlog.Event) error {
+	switch event.Type {
+	case binlog.TableMapEvent:
+		if !s.isUsers(event.Table) {
+			return nil
+		}
+		// MySQL assigns a new table id when an altered table is reopened,
+		// and a change of column types shows in the map itself; either way
+		// the names may have moved, so reload them.
+		if s.table == nil || event.Table.ID != s.table.ID || !slices.Equal(event.Table.Columns, s.table.Columns) {
+			columns, err := s.worker.db.ColumnNames(ctx, usersTable)
+			if err != nil {
+				return fmt.Errorf("load %s columns: %w", usersTable, err)
+			}
+			s.table, s.columns = event.Table, columns
+		}
+
+	case binlog.WriteRowsEvent, binlog.UpdateRowsEvent, binlog.DeleteRowsEvent:
+		if !s.isUsers(event.Table) {
+			return nil
+		}
+		for _, row := range event.Rows {
+			if err := s.collect(row); err != nil {
+				return err
+			}
+		}
+
+	case binlog.XIDEvent:
+		if err := s.apply(ctx); err != nil {
+			return err
+		}
+		s.advance(event.Position)
+
+	case binlog.RotateEvent:
+		if len(s.pending) == 0 {
+			s.advance(event.Position)
+		}
+	}
+	return nil
+}
+
+func (s *cdcSession) isUsers(table *binlog.Table) bool {
+	return table != nil && table.Schema == s.worker.cfg.DB.Name && table.Name == usersTable
+}
+
+// collect folds one row change into the pending transaction.
+func (s *cdcSession) collect(row binlog.Row) error {
+	if row.Before != nil {
+		before, err := s.user(row.Before)
+		if err != nil {
+			return err
+		}
+		s.pending[before.Username] = nil
+	}
+
+	if row.After != nil {
+		after, err := s.user(row.After)
+		if err != nil {
+			return err
+		}
+		s.pending[after.Username] = after
+	}
+	return nil
+}
+
+func (s *cdcSession) user(values []any) (*models.User, error) {
+	if len(values) != len(s.columns) {
+		return nil, fmt.Errorf("row has %d columns, %s has %d", len(values), usersTable, len(s.columns))
+	}
+
+	user := &models.User{}
+	for i, name := range s.columns {
+		switch v := values[i].(type) {
+		case int64:
+			if name == "id" {
+				user.ID = v
+			}
+		case string:
+			switch name {
+			case "username":
+				user.Username = v
+			case "password_hash":
+				user.PasswordHash = v
+			}
+		case time.Time:
+			if name == "created_at" {
+				user.CreatedAt = v
+			}
+		}
+	}
+
+	if user.Username == "" || user.PasswordHash == "" {
+		return nil, errors.New("row image is missing username or password_hash; set binlog_row_image=FULL")
+	}
+	return user, nil
+}
+
+// apply writes the committed transaction's changes to Redis and tells
+// auth-improved replicas to drop their local copies.
+func (s *cdcSession) apply(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	if err := s.fence(ctx); err != nil {
+		return err
+	}
+
+	w := s.worker
+	sets := make(map[string]string)
+	var deletes []string
+	for username, user := range s.pending {
+		if user == nil {
+			deletes = append(deletes, username)
+			continue
+		}
+
+		data, err := w.codec.Encode(&codec.Entry{User: user, SoftExpiresAt: w.redis.SoftExpiry()})
+		if err != nil {
+			return fmt.Errorf("encode user %s: %w", username, err)
+		}
+		sets[username] = string(data)
+	}
+
+	if len(deletes) > 0 {
+		if err := w.redis.DeleteBatch(ctx, deletes); err != nil {
+			return fmt.Errorf("evict deleted users: %w", err)
+		}
+	}
+	if len(sets) > 0 {
+		if err := w.redis.SetBatch(ctx, sets); err != nil {
+			return fmt.Errorf("cache changed users: %w", err)
+		}
+	}
+
+	for username, user := range s.pending {
+		if user != nil && w.cfg.Features.BloomFilterEnabled {
+			if err := w.redis.BloomAdd(ctx, username); err != nil {
+				slog.Error("Failed to add user to bloom filter", "username", username, "error", err)
+			}
+		}
+		if err := w.redis.PublishInvalidation(ctx, username); err != nil {
+			slog.Error("Failed to publish invalidation", "username", username, "error", err)
+		}
+	}
+
+	slog.Debug("Applied binlog transaction", "updated", len(sets), "deleted", len(deletes))
+	clear(s.pending)
+	return nil
+}
+
+func (s *cdcSession) advance(pos binlog.Position) {
+	s.checkpoint = pos
+	s.dirty = true
+
+	if time.Since(s.savedAt) >= cdcCheckpointInterval {
+		s.saveCheckpoint()
+	}
+}
+
+// saveCheckpoint persists the position after the last applied transaction.
+// It uses its own context so the final checkpoint is written on shutdown.
+func (s *cdcSession) saveCheckpoint() {
+	if !s.dirty {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.fence(ctx); err != nil {
+		slog.Warn("Not saving binlog position", "position", s.checkpoint.String(), "error", err)
+		return
+	}
+	if err := s.worker.db.SetState(ctx, stateBinlogPosition, s.checkpoint.String()); err != nil {
+		slog.Error("Failed to save binlog position", "position", s.checkpoint.String(), "error", err)
+		return
+	}
+
+	s.dirty = false
+	s.savedAt = time.Now()
+}
+
+func (s *cdcSession) fence(ctx context.Context) error {
+	if s.worker.elector == nil {
+		return nil
+	}
+	return s.worker.elector.fence(ctx, s.token)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/binlog"
+	"substack-auth/pkg/binlog/binlogtest"
+	"substack-auth/pkg/config"
+)
+
+func newTestTail(t *testing.T, server *binlogtest.Server, ttl time.Duration) *testEnv {
+	t.Helper()
+
+	return newTestWorker(t, func(cfg *config.Config) {
+		cfg.Precache.Mode = ModeCDC
+		cfg.DB.Host = server.Host()
+		cfg.DB.Port = server.Port()
+		cfg.Redis.TTL = ttl.String()
+		cfg.Redis.TTLJitter = "0"
+	})
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTailResyncKeepsEntriesPastTTL(t *testing.T) {
+	const ttl = time.Minute
+	server := binlogtest.New(t, nil)
+	env := newTestTail(t, server, ttl)
+	user := env.db.AddUser("test@katakode.com", "$2a$10$hash")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- env.worker.Tail(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// Without a checkpoint the tail sweeps before it starts streaming.
+	waitFor(t, "the first binlog dump", func() bool { return server.Dumps() == 1 })
+	if env.cached(t, user.Username) == nil {
+		t.Fatal("user not cached by the initial sweep")
+	}
+
+	env.mr.FastForward(ttl * 3 / 4)
+	env.worker.Resync()
+	waitFor(t, "the binlog dump after the resync", func() bool { return server.Dumps() == 2 })
+
+	// A whole TTL after the first sweep the entry is only alive if the
+	// resync rewrote it.
+	env.mr.FastForward(ttl / 2)
+	if env.cached(t, user.Username) == nil {
+		t.Error("entry expired although the schedule asked the tail to resync")
+	}
+}
+
+func TestTailStopsOnUnsupportedAuth(t *testing.T) {
+	server := binlogtest.New(t, func(s *binlogtest.Server) {
+		s.Plugin = "caching_sha2_password"
+		s.FullAuth = true
+	})
+	env := newTestTail(t, server, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := env.worker.Tail(ctx); !errors.Is(err, binlog.ErrUnsupported) {
+		t.Errorf("Tail err = %v, want %v", err, binlog.ErrUnsupported)
+	}
+}
@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const checkpointName = "precache-run"
+
+// checkpoint is the persisted cursor of a full sweep. Every user with an id
+// up to LastID has been written by run RunID, which started the sweep at
+// StartedAt, or by the runs that resumed it; Runs counts them all.
+type checkpoint struct {
+	RunID     string
+	StartedAt time.Time
+	LastID    int64
+	Processed int
+	Runs      int
+}
+
+// loadCheckpoint returns the checkpoint of an interrupted full sweep, if
+// there is one and this run was not asked to restart.
+func (w *Worker) loadCheckpoint(ctx context.Context) (*checkpoint, error) {
+	if w.restart {
+		slog.Info("Restarting precache from the beginning, discarding checkpoint")
+		return nil, w.ResetCheckpoint(ctx)
+	}
+
+	fields, err := w.redis.LoadCheckpoint(ctx, checkpointName)
+	if err != nil {
+		return nil, fmt.Errorf("load precache checkpoint: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	lastID, err := strconv.ParseInt(fields["last_id"], 10, 64)
+	if err != nil {
+		slog.Warn("Ignoring unreadable precache checkpoint", "error", err)
+		return nil, nil
+	}
+	processed, _ := strconv.Atoi(fields["processed"])
+	// Checkpoints written before runs were counted had exactly one.
+	runs, _ := strconv.Atoi(fields["runs"])
+	// Older checkpoints have no start time; the zero time tells Run not to
+	// move the watermark.
+	startedAt, _ := time.Parse(time.RFC3339Nano, fields["started_at"])
+
+	return &checkpoint{RunID: fields["run_id"], StartedAt: startedAt, LastID: lastID, Processed: processed, Runs: max(runs, 1)}, nil
+}
+
+// saveCheckpoint records that the active run has written every user up to
+// lastID. The checkpoint expires after PRECACHE_CHECKPOINT_TTL without a
+// save: by then the entries written before the interruption are close to
+// their own TTL and a fresh sweep is the better choice.
+func (w *Worker) saveCheckpoint(ctx context.Context, lastID int64) {
+	progress := w.Progress()
+	if progress == nil {
+		return
+	}
+
+	runID := progress.RunID
+	if progress.ResumedFromRun != "" {
+		runID = progress.ResumedFromRun
+	}
+
+	fields := map[string]any{
+		"run_id":     runID,
+		"last_id":    lastID,
+		"processed":  progress.Processed,
+		"runs":       progress.priorRuns + 1,
+		"updated_at": time.Now().UTC().Format(time.RFC3339),
+	}
+	if !w.sweepStartedAt.IsZero() {
+		fields["started_at"] = w.sweepStartedAt.Format(time.RFC3339Nano)
+	}
+
+	err := w.redis.SaveCheckpoint(ctx, checkpointName, fields, w.cfg.Precache.CheckpointTTL)
+	if err != nil {
+		// Losing a checkpoint only costs redoing work after a crash.
+		slog.Error("Failed to save precache checkpoint", "last_id", lastID, "error", err)
+	}
+}
+
+// ResetCheckpoint discards the checkpoint of an interrupted run so the
+// next full sweep starts from the first user.
+func (w *Worker) ResetCheckpoint(ctx context.Context) error {
+	if err := w.redis.ClearCheckpoint(ctx, checkpointName); err != nil {
+		return fmt.Errorf("clear precache checkpoint: %w", err)
+	}
+	return nil
+}
+
+// resume makes the active run continue the interrupted one. It keeps its own
+// run id, records the run that started the sweep and takes over the
+// processed count.
+func (w *Worker) resume(cp *checkpoint) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress == nil {
+		return
+	}
+	w.progress.ResumedFromRun = cp.RunID
+	w.progress.priorRuns = cp.Runs
+	w.progress.LastID = cp.LastID
+	w.progress.Processed = cp.Processed
+	w.progress.ResumedFrom = cp.LastID
+}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/models"
+)
+
+// interruptedSweep leaves the checkpoint a sweep started at startedAt would
+// have written after caching the first two users, then discards its
+// progress as if the process had exited.
+func interruptedSweep(t *testing.T, env *testEnv, users []models.User, startedAt time.Time) {
+	t.Helper()
+
+	w := env.worker
+	w.setProgress(&Progress{RunID: "interrupted", StartedAt: startedAt, Processed: 2}, nil)
+	w.sweepStartedAt = startedAt
+	w.saveCheckpoint(context.Background(), users[1].ID)
+	w.setProgress(nil, nil)
+	w.sweepStartedAt = time.Time{}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	env := newTestWorker(t, func(cfg *config.Config) {
+		cfg.Precache.Mode = ModeIncremental
+	})
+	ctx := context.Background()
+
+	sweepStart := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	env.db.SetNow(sweepStart)
+	var users []models.User
+	for _, username := range []string{"a@katakode.com", "b@katakode.com", "c@katakode.com", "d@katakode.com"} {
+		users = append(users, env.db.AddUser(username, "$2a$10$hash"))
+	}
+	interruptedSweep(t, env, users, sweepStart)
+
+	cp, err := env.worker.loadCheckpoint(ctx)
+	if err != nil || cp == nil {
+		t.Fatalf("loadCheckpoint = %+v, %v", cp, err)
+	}
+	if !cp.StartedAt.Equal(sweepStart) || cp.RunID != "interrupted" || cp.LastID != users[1].ID {
+		t.Fatalf("checkpoint = %+v, want run interrupted at id %d started %s", cp, users[1].ID, sweepStart)
+	}
+
+	resumedAt := sweepStart.Add(time.Hour)
+	env.db.SetNow(resumedAt)
+	record, err := env.worker.Execute(ctx, "test")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+
+	if record.ResumedFrom != users[1].ID || record.ResumedFromRun != "interrupted" {
+		t.Errorf("resumed from %d of run %q, want %d of run interrupted", record.ResumedFrom, record.ResumedFromRun, users[1].ID)
+	}
+	if record.Processed != len(users) {
+		t.Errorf("processed = %d, want %d including the interrupted run's", record.Processed, len(users))
+	}
+	// The resumed run only reads the users after the checkpoint.
+	for i, user := range users {
+		if cached := env.cached(t, user.Username) != nil; cached != (i >= 2) {
+			t.Errorf("%s cached = %v, want %v", user.Username, cached, i >= 2)
+		}
+	}
+	if cp, _ := env.worker.loadCheckpoint(ctx); cp != nil {
+		t.Errorf("checkpoint %+v kept after the sweep completed", cp)
+	}
+
+	// Rows changed between the first start and the resume may have been
+	// read before they changed, so both times stay at the first start.
+	for _, name := range []string{stateWatermark, stateLastFullSweep} {
+		got, ok, err := env.worker.loadTime(ctx, name)
+		if err != nil || !ok || !got.Equal(sweepStart) {
+			t.Errorf("%s = %s (set %v, err %v), want %s", name, got, ok, err, sweepStart)
+		}
+	}
+}
+
+func TestResumeFromCheckpointWithoutStartTime(t *testing.T) {
+	env := newTestWorker(t, func(cfg *config.Config) {
+		cfg.Precache.Mode = ModeIncremental
+	})
+	ctx := context.Background()
+
+	var users []models.User
+	for _, username := range []string{"a@katakode.com", "b@katakode.com", "c@katakode.com"} {
+		users = append(users, env.db.AddUser(username, "$2a$10$hash"))
+	}
+	// A checkpoint written before the start time was recorded.
+	interruptedSweep(t, env, users, time.Time{})
+
+	if _, err := env.worker.Execute(ctx, "test"); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if env.cached(t, users[2].Username) == nil {
+		t.Error("resumed sweep did not cache the users after the checkpoint")
+	}
+	for _, name := range []string{stateWatermark, stateLastFullSweep} {
+		if value, ok, _ := env.db.State(ctx, name); ok {
+			t.Errorf("%s = %q, want it left unset", name, value)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/models"
+	"substack-auth/pkg/redis"
+)
+
+// Rough per-entry cost beyond the name and value bytes: a top-level string
+// key carries its dict entry, object headers and expiry, a listpack field
+// only a few length bytes.
+const (
+	stringEntryOverhead = 72
+	hashEntryOverhead   = 4
+)
+
+// DryRunReport is what a full sweep with the current configuration would do
+// to the cache.
+type DryRunReport struct {
+	Users     int `json:"users"`
+	Batches   int `json:"batches"`
+	New       int `json:"new"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+	// Evicted counts entries of deleted users a sweep would remove; it stays
+	// zero when PRECACHE_EVICT_DELETED is off.
+	Evicted int `json:"evicted"`
+	// Untouched counts entries the sweep would neither write nor evict, such
+	// as ones stored under a previous key format. They expire with their TTL.
+	Untouched int `json:"untouched"`
+	// MemoryDelta estimates the change in Redis memory, in bytes.
+	MemoryDelta int64  `json:"estimated_memory_delta_bytes"`
+	Duration    string `json:"duration"`
+}
+
+// DryRun walks the users table like a full sweep and compares what it would
+// write with what Redis holds, without writing anything. An entry is
+// unchanged when a sweep would only refresh it (see sameEntry); anything
+// else that is present counts as changed. Only entries in the configured
+// REDIS_LAYOUT are visible to the comparison.
+func (w *Worker) DryRun(ctx context.Context) (*DryRunReport, error) {
+	started := time.Now()
+	report := &DryRunReport{}
+	seen := make(seenKeys)
+
+	slog.Info("Starting precache dry run", "batch_size", w.cfg.Precache.BatchSize, "codec", w.codec.Name(), "layout", w.cfg.Redis.Layout)
+
+	batch := make([]models.User, 0, w.cfg.Precache.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := w.compareBatch(ctx, batch, report); err != nil {
+			return err
+		}
+		report.Batches++
+		batch = batch[:0]
+		return nil
+	}
+
+	err := w.db.StreamUsers(ctx, 0, func(user models.User) error {
+		seen.add(w.redis.KeyFor(user.Username))
+		batch = append(batch, user)
+		if len(batch) < w.cfg.Precache.BatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compare users: %w", err)
+	}
+
+	if err := w.compareUnseen(ctx, seen, report); err != nil {
+		return nil, err
+	}
+
+	report.Duration = time.Since(started).String()
+	slog.Info("Precache dry run completed", "users", report.Users, "new", report.New, "changed", report.Changed,
+		"unchanged", report.Unchanged, "evicted", report.Evicted, "untouched", report.Untouched,
+		"estimated_memory_delta_bytes", report.MemoryDelta)
+	return report, nil
+}
+
+// compareBatch classifies one batch of users against their cached entries.
+func (w *Worker) compareBatch(ctx context.Context, users []models.User, report *DryRunReport) error {
+	usernames := make([]string, len(users))
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+
+	cached, err := w.redis.GetBatch(ctx, usernames)
+	if err != nil {
+		return fmt.Errorf("read cached users: %w", err)
+	}
+
+	for _, user := range users {
+		report.Users++
+
+		data, err := w.codec.Encode(&codec.Entry{User: &user, SoftExpiresAt: w.redis.SoftExpiry()})
+		if err != nil {
+			slog.Error("Failed to encode user", "username", user.Username, "error", err)
+			continue
+		}
+
+		old, ok := cached[user.Username]
+		if !ok {
+			report.New++
+			report.MemoryDelta += w.entrySize(w.redis.KeyFor(user.Username), len(data))
+			continue
+		}
+
+		report.MemoryDelta += int64(len(data) - len(old))
+		if w.sameEntry([]byte(old), data, &user) {
+			report.Unchanged++
+		} else {
+			report.Changed++
+		}
+	}
+	return nil
+}
+
+// compareUnseen classifies the cached entries no user maps to, the way
+// evictDeleted would treat them.
+func (w *Worker) compareUnseen(ctx context.Context, seen seenKeys, report *DryRunReport) error {
+	checked := make(map[string]bool)
+
+	return w.redis.ScanKeys(ctx, func(names []string) error {
+		var unseen []string
+		for _, name := range names {
+			if seen.has(name) || checked[name] {
+				continue
+			}
+			checked[name] = true
+			unseen = append(unseen, name)
+		}
+		if len(unseen) == 0 {
+			return nil
+		}
+
+		if !w.cfg.Precache.EvictDeleted {
+			report.Untouched += len(unseen)
+			return nil
+		}
+
+		found, err := w.checkCandidates(ctx, unseen)
+		if err != nil {
+			return err
+		}
+
+		deleted := found.deleted()
+		for _, name := range deleted {
+			report.MemoryDelta -= w.entrySize(name, len(found.values[name]))
+		}
+		report.Evicted += len(deleted)
+		report.Untouched += len(unseen) - len(deleted)
+		return nil
+	})
+}
+
+func (w *Worker) entrySize(name string, valueLen int) int64 {
+	if w.cfg.Redis.Layout == redis.LayoutHash {
+		return int64(len(name) + valueLen + hashEntryOverhead)
+	}
+	return int64(len(w.cfg.Redis.Prefix) + len(name) + valueLen + stringEntryOverhead)
+}
+
+// sameEntry reports whether writing data over old would only refresh it:
+// old holds the same user in the same codec envelope, with soft expiry set
+// exactly when the sweep would set it. The bytes themselves differ between
+// any two writes, as the soft expiry is jittered and encryption uses a fresh
+// nonce.
+func (w *Worker) sameEntry(old, data []byte, user *models.User) bool {
+	entry, err := w.codec.Decode(old)
+	if err != nil || !sameUser(entry.User, user) {
+		return false
+	}
+	if entry.SoftExpiresAt.IsZero() != w.redis.SoftExpiry().IsZero() {
+		return false
+	}
+
+	oldEnvelope, err := codec.Envelope(w.codec, old)
+	if err != nil {
+		return false
+	}
+	newEnvelope, err := codec.Envelope(w.codec, data)
+	return err == nil && oldEnvelope == newEnvelope
+}
+
+func sameUser(a, b *models.User) bool {
+	return a.ID == b.ID && a.Username == b.Username && a.PasswordHash == b.PasswordHash && a.CreatedAt.Equal(b.CreatedAt)
+}
@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/config"
+)
+
+func TestDryRunComparesEnvelope(t *testing.T) {
+	signing := func(active string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.Cache.Codec = "binary"
+			cfg.Features.CacheSigningEnabled = true
+			cfg.Cache.HMACSecrets = []string{
+				"s1:first-secret-of-at-least-32-bytes",
+				"s2:second-secret-of-at-least-32-bytes",
+			}
+			cfg.Cache.HMACActiveSecret = active
+		}
+	}
+
+	tests := []struct {
+		name string
+		// written configures the codec the cached entry was written with.
+		written     func(*config.Config)
+		softExpiry  bool
+		wantChanged bool
+	}{
+		{"same settings", func(*config.Config) {}, false, false},
+		{"other codec", func(cfg *config.Config) { cfg.Cache.Codec = "json" }, false, true},
+		{"unsigned", func(cfg *config.Config) { cfg.Features.CacheSigningEnabled = false }, false, true},
+		{"rotated secret", signing("s1"), false, true},
+		{"soft expiry set", func(*config.Config) {}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestWorker(t, signing("s2"))
+			ctx := context.Background()
+			user := env.db.AddUser("test@katakode.com", "$2a$10$hash")
+
+			written := *env.cfg
+			tt.written(&written)
+			c, err := codec.New(&written)
+			if err != nil {
+				t.Fatalf("codec.New: %v", err)
+			}
+			entry := &codec.Entry{User: &user}
+			if tt.softExpiry {
+				entry.SoftExpiresAt = time.Now().Add(time.Hour)
+			}
+			data, err := c.Encode(entry)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if err := env.redis.Set(ctx, user.Username, string(data)); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+
+			report, err := env.worker.DryRun(ctx)
+			if err != nil {
+				t.Fatalf("DryRun: %v", err)
+			}
+			if changed := report.Changed == 1; changed != tt.wantChanged || report.Changed+report.Unchanged != 1 {
+				t.Errorf("report = %+v, want changed %v", report, tt.wantChanged)
+			}
+		})
+	}
+}
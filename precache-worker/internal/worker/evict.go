@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// seenKeys records which cache entries a full sweep wrote. It keeps 64-bit
+// fingerprints of the stored names rather than the names themselves so a
+// million users cost tens of megabytes; a fingerprint collision only means
+// one deleted user survives until its TTL.
+type seenKeys map[uint64]struct{}
+
+func (s seenKeys) add(name string) {
+	s[fingerprint(name)] = struct{}{}
+}
+
+func (s seenKeys) has(name string) bool {
+	_, ok := s[fingerprint(name)]
+	return ok
+}
+
+func fingerprint(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// evictDeleted deletes cache entries that the sweep did not write because
+// their user no longer exists. Candidates are decoded and checked against
+// MySQL before deletion, so users created after the sweep passed their id
+// are kept. It returns the number of evicted users.
+func (w *Worker) evictDeleted(ctx context.Context, seen seenKeys) (int, error) {
+	evicted := 0
+	// The hash layout can report a name once per live generation.
+	checked := make(map[string]bool)
+
+	err := w.redis.ScanKeys(ctx, func(names []string) error {
+		var candidates []string
+		for _, name := range names {
+			if seen.has(name) || checked[name] {
+				continue
+			}
+			checked[name] = true
+			candidates = append(candidates, name)
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+
+		found, err := w.checkCandidates(ctx, candidates)
+		if err != nil {
+			return err
+		}
+
+		deleted := found.deleted()
+		if len(deleted) == 0 {
+			return nil
+		}
+
+		if err := w.checkFence(ctx); err != nil {
+			return err
+		}
+		if err := w.redis.DeleteNames(ctx, deleted); err != nil {
+			return fmt.Errorf("evict deleted users: %w", err)
+		}
+
+		for username, name := range found.usernames {
+			if found.existing[username] {
+				continue
+			}
+			if err := w.redis.PublishInvalidation(ctx, username); err != nil {
+				slog.Error("Failed to publish invalidation", "username", username, "error", err)
+			}
+			slog.Debug("Evicted deleted user", "name", name)
+		}
+
+		evicted += len(deleted)
+		w.recordEvicted(len(deleted))
+		return nil
+	})
+	return evicted, err
+}
+
+// candidates describes cache entries a sweep did not write: their stored
+// values, the username each readable entry belongs to, and which of those
+// users still exist.
+type candidates struct {
+	values    map[string]string
+	usernames map[string]string
+	existing  map[string]bool
+}
+
+// deleted returns the names of entries whose user no longer exists.
+func (c *candidates) deleted() []string {
+	var names []string
+	for username, name := range c.usernames {
+		if !c.existing[username] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkCandidates reads the given entries and looks their users up in
+// MySQL. Entries that do not decode, or that are stored under a name other
+// than their user's current key, are left out of usernames and never
+// evicted.
+func (w *Worker) checkCandidates(ctx context.Context, names []string) (*candidates, error) {
+	values, err := w.redis.GetNames(ctx, names)
+	if err != nil {
+		return nil, fmt.Errorf("read eviction candidates: %w", err)
+	}
+
+	usernames := make(map[string]string, len(values))
+	for name, value := range values {
+		entry, err := w.codec.Decode([]byte(value))
+		if err != nil || w.redis.KeyFor(entry.User.Username) != name {
+			// auth-improved already refuses entries it cannot verify.
+			slog.Debug("Skipping unreadable cache entry", "name", name, "error", err)
+			continue
+		}
+		usernames[entry.User.Username] = name
+	}
+
+	existing, err := w.db.ExistingUsernames(ctx, slices.Collect(maps.Keys(usernames)))
+	if err != nil {
+		return nil, fmt.Errorf("check eviction candidates: %w", err)
+	}
+
+	return &candidates{values: values, usernames: usernames, existing: existing}, nil
+}
@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-auth/pkg/models"
+)
+
+const ModeHot = "hot"
+
+// sweepHot caches only the users auth-improved has seen log in recently:
+// the PRECACHE_HOT_SET_SIZE most recent ones active within
+// PRECACHE_HOT_SET_WINDOW. Users are written hottest first so a memory
+// budget cuts off the coldest. The Bloom filter is left alone, and nothing
+// is evicted; cold users simply age out through their TTL.
+func (w *Worker) sweepHot(ctx context.Context, now time.Time) error {
+	var since time.Time
+	if window := w.cfg.Precache.HotSetWindow; window > 0 {
+		since = now.Add(-window)
+	}
+
+	ids, err := w.redis.ActiveUsers(ctx, since, w.cfg.Precache.HotSetSize)
+	if err != nil {
+		return fmt.Errorf("load active users: %w", err)
+	}
+	slog.Info("Loading hot set", "active_users", len(ids), "since", since, "limit", w.cfg.Precache.HotSetSize)
+
+	totalProcessed := 0
+	for start := 0; start < len(ids); start += w.cfg.Precache.BatchSize {
+		chunk := ids[start:min(start+w.cfg.Precache.BatchSize, len(ids))]
+
+		found, err := w.db.UsersByIDs(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		users := hottestFirst(chunk, found)
+
+		if err := w.forgetMissing(ctx, chunk, users); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			continue
+		}
+
+		if err := w.checkFence(ctx); err != nil {
+			return err
+		}
+
+		admitted, err := w.admit(ctx, users)
+		if err != nil {
+			return err
+		}
+
+		if err := w.cacheUsers(ctx, admitted); err != nil {
+			return err
+		}
+
+		totalProcessed += len(users)
+		w.recordBatch(users[len(users)-1].ID, len(users))
+
+		slog.Info("Processed hot batch", "count", len(users), "total_processed", totalProcessed)
+	}
+
+	slog.Info("Hot-set precache completed", "total_processed", totalProcessed)
+	return nil
+}
+
+// hottestFirst orders the loaded users like ids, which is most recently
+// active first.
+func hottestFirst(ids []int64, found []models.User) []models.User {
+	byID := make(map[int64]models.User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+
+	users := make([]models.User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// forgetMissing drops ids of deleted users from the activity set so they
+// stop taking hot-set slots.
+func (w *Worker) forgetMissing(ctx context.Context, ids []int64, users []models.User) error {
+	if len(users) == len(ids) {
+		return nil
+	}
+
+	loaded := make(map[int64]bool, len(users))
+	for _, user := range users {
+		loaded[user.ID] = true
+	}
+
+	var missing []int64
+	for _, id := range ids {
+		if !loaded[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	if err := w.redis.ForgetActivity(ctx, missing); err != nil {
+		return fmt.Errorf("forget deleted users' activity: %w", err)
+	}
+	return nil
+}
+
+// pruneActivity drops logins older than ACTIVITY_RETENTION. It runs at the
+// start of every run, whatever the mode, so the set stays bounded even when
+// tracking is left on without hot runs to consume it.
+func (w *Worker) pruneActivity(ctx context.Context, now time.Time) {
+	retention := w.cfg.Precache.ActivityRetention
+	if retention <= 0 {
+		return
+	}
+
+	pruned, err := w.redis.PruneActivity(ctx, now.Add(-retention))
+	if err != nil {
+		slog.Warn("Failed to prune login activity", "error", err)
+	} else if pruned > 0 {
+		slog.Info("Pruned login activity", "removed", pruned, "retention", retention)
+	}
+}
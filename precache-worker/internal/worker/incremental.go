@@ -0,0 +1,233 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-auth/pkg/models"
+)
+
+const (
+	ModeFull        = "full"
+	ModeIncremental = "incremental"
+
+	stateWatermark     = "watermark"
+	stateLastFullSweep = "last_full_sweep"
+)
+
+// Run brings the cache up to date with MySQL. In full mode it rewrites every
+// user. In incremental mode it only loads users whose updated_at is at or
+// after the persisted watermark, falling back to a full sweep when there is
+// no watermark yet or the last full sweep is older than
+// PRECACHE_FULL_SWEEP_INTERVAL. In hot mode it caches only recently active
+// users; see sweepHot.
+func (w *Worker) Run(ctx context.Context) error {
+	slog.Info("Starting precache worker", "batch_size", w.cfg.Precache.BatchSize, "codec", w.codec.Name())
+
+	// Taken before reading anything so rows changed during the run are
+	// picked up by the next one.
+	startedAt, err := w.db.Now(ctx)
+	if err != nil {
+		return fmt.Errorf("read database clock: %w", err)
+	}
+
+	w.budget = newMemoryBudget(w.redis, w.cfg.Precache.MemoryBudget, w.cfg.Precache.MemoryPolicy)
+
+	// Login activity is scored by auth-improved's clock, not the database's,
+	// so its cutoffs are measured against local time.
+	now := time.Now()
+	w.pruneActivity(ctx, now)
+
+	// Hot runs cover only part of the table, so they neither read nor move
+	// the watermark.
+	if w.cfg.Precache.Mode == ModeHot {
+		w.setMode(ModeHot)
+		return w.sweepHot(ctx, now)
+	}
+
+	since, full, err := w.plan(ctx, startedAt)
+	if err != nil {
+		return err
+	}
+
+	if full {
+		w.setMode(ModeFull)
+		w.sweepStartedAt = startedAt
+		err = w.sweepAll(ctx)
+	} else {
+		w.setMode(ModeIncremental)
+		err = w.sweepChanged(ctx, since)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The users before a resumed sweep's checkpoint were read by the runs it
+	// continues, so only changes made after the sweep first started are
+	// known to be cached.
+	if full {
+		startedAt = w.sweepStartedAt
+		if startedAt.IsZero() {
+			slog.Warn("Resumed sweep has no start time, leaving the precache watermark unchanged")
+			return nil
+		}
+	}
+	return w.saveWatermark(ctx, startedAt, full)
+}
+
+// plan decides between a full and an incremental run. For incremental runs
+// it returns the lower bound on updated_at, which reaches
+// PRECACHE_WATERMARK_OVERLAP behind the watermark to catch transactions that
+// committed after the previous run with an earlier timestamp.
+func (w *Worker) plan(ctx context.Context, now time.Time) (time.Time, bool, error) {
+	if w.cfg.Precache.Mode != ModeIncremental {
+		return time.Time{}, true, nil
+	}
+
+	watermark, ok, err := w.loadTime(ctx, stateWatermark)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !ok {
+		slog.Info("No precache watermark yet, running full sweep")
+		return time.Time{}, true, nil
+	}
+
+	lastFull, ok, err := w.loadTime(ctx, stateLastFullSweep)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !ok || now.Sub(lastFull) >= w.cfg.Precache.FullSweepInterval {
+		slog.Info("Full sweep due", "last_full_sweep", lastFull, "interval", w.cfg.Precache.FullSweepInterval)
+		return time.Time{}, true, nil
+	}
+
+	return watermark.Add(-w.cfg.Precache.WatermarkOverlap), false, nil
+}
+
+// CheckSchema refuses incremental mode on a database that predates the
+// updated_at column. schema.sql only creates missing tables, so existing
+// installs need the upgrade from the README first.
+func (w *Worker) CheckSchema(ctx context.Context) error {
+	if w.cfg.Precache.Mode != ModeIncremental {
+		return nil
+	}
+
+	columns, err := w.db.ColumnNames(ctx, usersTable)
+	if err != nil {
+		return fmt.Errorf("load %s columns: %w", usersTable, err)
+	}
+	for _, column := range columns {
+		if column == "updated_at" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no updated_at column; apply the upgrade in the README or set PRECACHE_MODE=full", usersTable)
+}
+
+// sweepChanged caches users modified since the given time. New usernames
+// are added to the published Bloom filter in place; the next full sweep
+// rebuilds it.
+func (w *Worker) sweepChanged(ctx context.Context, since time.Time) error {
+	slog.Info("Loading users changed since watermark", "since", since)
+
+	after := since
+	afterID := int64(0)
+	totalProcessed := 0
+
+	for {
+		changed, err := w.db.UsersChangedSince(ctx, since, after, afterID, w.cfg.Precache.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		if len(changed) == 0 {
+			break
+		}
+
+		users := make([]models.User, len(changed))
+		for i, user := range changed {
+			users[i] = user.User
+		}
+
+		if err := w.checkFence(ctx); err != nil {
+			return err
+		}
+
+		admitted, err := w.admit(ctx, users)
+		if err != nil {
+			return err
+		}
+
+		if err := w.cacheUsers(ctx, admitted); err != nil {
+			return err
+		}
+
+		// New users join the filter even when the budget kept them out of
+		// the cache; auth-improved falls back to MySQL for them.
+		if w.cfg.Features.BloomFilterEnabled {
+			for _, user := range users {
+				if err := w.redis.BloomAdd(ctx, user.Username); err != nil {
+					slog.Error("Failed to add user to bloom filter", "username", user.Username, "error", err)
+					return err
+				}
+			}
+		}
+
+		last := changed[len(changed)-1]
+		after, afterID = last.UpdatedAt, last.ID
+		totalProcessed += len(changed)
+		w.recordBatch(last.ID, len(changed))
+
+		slog.Info("Processed changed batch", "updated_at", after, "last_id", afterID, "count", len(changed), "total_processed", totalProcessed)
+
+		if len(changed) < w.cfg.Precache.BatchSize {
+			break
+		}
+	}
+
+	slog.Info("Incremental precache completed", "total_processed", totalProcessed)
+	return nil
+}
+
+// saveWatermark persists the run's start time so the next incremental run
+// continues from it. Full runs also record when the last full sweep began.
+func (w *Worker) saveWatermark(ctx context.Context, startedAt time.Time, full bool) error {
+	if err := w.checkFence(ctx); err != nil {
+		return err
+	}
+
+	err := w.db.SetState(ctx, stateWatermark, startedAt.Format(time.RFC3339Nano))
+	if err == nil && full {
+		err = w.db.SetState(ctx, stateLastFullSweep, startedAt.Format(time.RFC3339Nano))
+	}
+	if err == nil {
+		return nil
+	}
+
+	// Full mode does not depend on the watermark, so a database without the
+	// precache_state table keeps working.
+	if w.cfg.Precache.Mode != ModeIncremental {
+		slog.Warn("Failed to save precache watermark", "error", err)
+		return nil
+	}
+	return fmt.Errorf("save precache watermark: %w", err)
+}
+
+func (w *Worker) loadTime(ctx context.Context, name string) (time.Time, bool, error) {
+	value, ok, err := w.db.State(ctx, name)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("load precache %s: %w", name, err)
+	}
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("parse precache %s %q: %w", name, value, err)
+	}
+	return t, true, nil
+}
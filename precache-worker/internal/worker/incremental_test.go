@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/config"
+)
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	watermark := now.Add(-10 * time.Minute)
+
+	tests := []struct {
+		name      string
+		mode      string
+		state     map[string]time.Time
+		wantFull  bool
+		wantSince time.Time
+	}{
+		{"full mode", ModeFull, map[string]time.Time{stateWatermark: watermark, stateLastFullSweep: now.Add(-time.Hour)}, true, time.Time{}},
+		{"no watermark", ModeIncremental, nil, true, time.Time{}},
+		{"no full sweep recorded", ModeIncremental, map[string]time.Time{stateWatermark: watermark}, true, time.Time{}},
+		{"full sweep due", ModeIncremental, map[string]time.Time{stateWatermark: watermark, stateLastFullSweep: now.Add(-24 * time.Hour)}, true, time.Time{}},
+		{"incremental", ModeIncremental, map[string]time.Time{stateWatermark: watermark, stateLastFullSweep: now.Add(-time.Hour)}, false, watermark.Add(-time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestWorker(t, func(cfg *config.Config) {
+				cfg.Precache.Mode = tt.mode
+				cfg.Precache.FullSweepInterval = 24 * time.Hour
+				cfg.Precache.WatermarkOverlap = time.Minute
+			})
+			ctx := context.Background()
+			for name, value := range tt.state {
+				if err := env.db.SetState(ctx, name, value.Format(time.RFC3339Nano)); err != nil {
+					t.Fatalf("SetState: %v", err)
+				}
+			}
+
+			since, full, err := env.worker.plan(ctx, now)
+			if err != nil {
+				t.Fatalf("plan: %v", err)
+			}
+			if full != tt.wantFull || !since.Equal(tt.wantSince) {
+				t.Errorf("plan = %v, %v, want %v, %v", since, full, tt.wantSince, tt.wantFull)
+			}
+		})
+	}
+}
+
+func TestIncrementalRunLoadsChangedUsers(t *testing.T) {
+	env := newTestWorker(t, func(cfg *config.Config) {
+		cfg.Precache.Mode = ModeIncremental
+		cfg.Precache.WatermarkOverlap = time.Minute
+	})
+	ctx := context.Background()
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	env.db.SetNow(start)
+	unchanged := env.db.AddUser("unchanged@katakode.com", "$2a$10$hash")
+	changed := env.db.AddUser("changed@katakode.com", "$2a$10$old")
+	env.db.SetUpdatedAt(unchanged.ID, start.Add(-time.Hour))
+	env.db.SetUpdatedAt(changed.ID, start.Add(-time.Hour))
+
+	// The first run has no watermark and sweeps everything.
+	if err := env.worker.Run(ctx); err != nil {
+		t.Fatalf("first Run: %v", err)
+	}
+	for _, username := range []string{unchanged.Username, changed.Username} {
+		if env.cached(t, username) == nil {
+			t.Fatalf("%s not cached by the full sweep", username)
+		}
+	}
+	if value, _, _ := env.db.State(ctx, stateWatermark); value != start.Format(time.RFC3339Nano) {
+		t.Fatalf("watermark = %q, want %s", value, start)
+	}
+
+	// Only users changed since the watermark are loaded next time.
+	env.mr.FlushAll()
+	env.db.SetNow(start.Add(10 * time.Minute))
+	if _, err := env.db.DB.Exec(`UPDATE users SET password_hash = ? WHERE username = ?`, "$2a$10$new", changed.Username); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if err := env.worker.Run(ctx); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	if entry := env.cached(t, changed.Username); entry == nil || entry.User.PasswordHash != "$2a$10$new" {
+		t.Errorf("changed user entry = %+v, want the new hash", entry)
+	}
+	if env.cached(t, unchanged.Username) != nil {
+		t.Error("incremental run loaded an unchanged user")
+	}
+}
+
+func TestRunMeasuresActivityByLocalClock(t *testing.T) {
+	env := newTestWorker(t, func(cfg *config.Config) {
+		cfg.Precache.Mode = ModeHot
+		cfg.Precache.HotSetWindow = time.Hour
+		cfg.Precache.ActivityRetention = time.Hour
+	})
+	ctx := context.Background()
+
+	user := env.db.AddUser("test@katakode.com", "$2a$10$hash")
+	if err := env.redis.RecordLogin(ctx, user.ID, time.Now()); err != nil {
+		t.Fatalf("RecordLogin: %v", err)
+	}
+	// Activity is scored by auth-improved's clock; a database clock running
+	// ahead must not push a fresh login out of the window or the retention.
+	env.db.SetNow(time.Now().Add(3 * time.Hour))
+
+	if err := env.worker.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if env.cached(t, user.Username) == nil {
+		t.Error("recently active user missing from the hot set")
+	}
+	if ids, _ := env.redis.ActiveUsers(ctx, time.Time{}, 10); len(ids) != 1 {
+		t.Errorf("activity = %v after pruning, want the login kept", ids)
+	}
+}
@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"substack-auth/pkg/redis"
+)
+
+const leaseName = "precache-worker"
+
+var (
+	// ErrNotLeader is returned by Execute on replicas that do not hold the
+	// precache lease.
+	ErrNotLeader = errors.New("precache worker is not the leader")
+
+	// ErrLeadershipLost aborts a run whose lease was taken over.
+	ErrLeadershipLost = errors.New("precache worker lost leadership")
+)
+
+// elector keeps a Redis lease so that only one worker replica precaches at
+// a time. Every replica campaigns; the holder renews the lease well before
+// it expires and a follower picks it up once the holder stops renewing.
+type elector struct {
+	redis    *redis.Redis
+	identity string
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	token   int64
+	leading bool
+	lost    chan struct{}
+}
+
+func newElector(redis *redis.Redis, identity string, ttl time.Duration) *elector {
+	if identity == "" {
+		host, _ := os.Hostname()
+		identity = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	return &elector{
+		redis:    redis,
+		identity: identity,
+		ttl:      ttl,
+		lost:     make(chan struct{}),
+	}
+}
+
+// campaign tries for the lease every third of its TTL until ctx is done,
+// then releases it so a follower can take over immediately.
+func (e *elector) campaign(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.attempt(ctx)
+
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// attempt acquires or renews the lease once and logs any change of
+// leadership.
+func (e *elector) attempt(ctx context.Context) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var (
+		token = e.token
+		ok    bool
+		err   error
+	)
+	if e.leading {
+		ok, err = e.redis.RenewLease(ctx, leaseName, e.identity, e.token, e.ttl)
+	} else {
+		token, ok, err = e.redis.AcquireLease(ctx, leaseName, e.identity, e.ttl)
+	}
+
+	if err != nil {
+		// Keep leading until the lease would have expired anyway; the
+		// per-batch fence check stops writes if someone else took over.
+		slog.Error("Failed to refresh precache lease", "instance", e.identity, "error", err)
+		return e.leading
+	}
+
+	switch {
+	case ok && !e.leading:
+		e.token = token
+		e.leading = true
+		e.lost = make(chan struct{})
+		slog.Info("Acquired precache leadership", "instance", e.identity, "fencing_token", token)
+	case !ok && e.leading:
+		e.leading = false
+		close(e.lost)
+		slog.Warn("Lost precache leadership", "instance", e.identity, "fencing_token", e.token)
+	}
+	return e.leading
+}
+
+// lead makes sure this replica holds the lease and returns a context that
+// is cancelled as soon as leadership is lost, along with the fencing token.
+func (e *elector) lead(ctx context.Context) (context.Context, context.CancelFunc, int64, error) {
+	if !e.attempt(ctx) {
+		return nil, nil, 0, ErrNotLeader
+	}
+
+	e.mu.Lock()
+	token, lost := e.token, e.lost
+	e.mu.Unlock()
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-lost:
+			cancel(ErrLeadershipLost)
+		case <-runCtx.Done():
+		}
+	}()
+	return runCtx, func() { cancel(nil) }, token, nil
+}
+
+// fence verifies against Redis that token is still the current tenure.
+func (e *elector) fence(ctx context.Context, token int64) error {
+	ok, err := e.redis.CheckLease(ctx, leaseName, e.identity, token)
+	if err != nil {
+		return fmt.Errorf("check precache lease: %w", err)
+	}
+	if !ok {
+		return ErrLeadershipLost
+	}
+	return nil
+}
+
+func (e *elector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.leading {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := e.redis.ReleaseLease(ctx, leaseName, e.identity, e.token); err != nil {
+		slog.Error("Failed to release precache lease", "instance", e.identity, "error", err)
+	}
+	e.leading = false
+	close(e.lost)
+	slog.Info("Released precache leadership", "instance", e.identity, "fencing_token", e.token)
+}
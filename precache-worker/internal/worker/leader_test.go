@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/redis/redistest"
+)
+
+func TestElectorHandoff(t *testing.T) {
+	mr, r, _ := redistest.New(t, nil)
+	ctx := context.Background()
+	first := newElector(r, "first", time.Second)
+	second := newElector(r, "second", time.Second)
+
+	runCtx, cancel, firstToken, err := first.lead(ctx)
+	if err != nil {
+		t.Fatalf("first lead: %v", err)
+	}
+	defer cancel()
+	if _, _, _, err := second.lead(ctx); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("second lead err = %v, want %v", err, ErrNotLeader)
+	}
+
+	// The leader stalls and stops renewing; a follower takes over.
+	mr.FastForward(2 * time.Second)
+	if !second.attempt(ctx) {
+		t.Fatal("follower did not take the expired lease")
+	}
+	if second.token <= firstToken {
+		t.Errorf("successor token = %d, want more than %d", second.token, firstToken)
+	}
+
+	if err := first.fence(ctx, firstToken); !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("old leader fence err = %v, want %v", err, ErrLeadershipLost)
+	}
+	if first.attempt(ctx) {
+		t.Error("old leader kept the lease on renewal")
+	}
+	select {
+	case <-runCtx.Done():
+		if cause := context.Cause(runCtx); !errors.Is(cause, ErrLeadershipLost) {
+			t.Errorf("run context cause = %v, want %v", cause, ErrLeadershipLost)
+		}
+	case <-time.After(time.Second):
+		t.Error("old leader's run context was not cancelled")
+	}
+	if err := second.fence(ctx, second.token); err != nil {
+		t.Errorf("new leader fence: %v", err)
+	}
+}
+
+func TestElectorResignHandsOverAtOnce(t *testing.T) {
+	_, r, _ := redistest.New(t, nil)
+	ctx := context.Background()
+	first := newElector(r, "first", time.Minute)
+	second := newElector(r, "second", time.Minute)
+
+	if !first.attempt(ctx) {
+		t.Fatal("first did not acquire the lease")
+	}
+	first.resign()
+
+	if !second.attempt(ctx) {
+		t.Error("follower could not take the lease right after resign")
+	}
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// refreshRetryDelay is the pause after a failed pass over the refresh queue.
+const refreshRetryDelay = 5 * time.Second
+
+// ConsumeRefreshes caches the users auth-improved queued on cache misses
+// until ctx is done. Each pass takes up to BATCH_SIZE user ids, loads them
+// with one query and writes them in one pipeline; while the queue is empty
+// it polls every REFRESH_QUEUE_POLL_INTERVAL. Popping is atomic, so every
+// replica can consume without leader election.
+func (w *Worker) ConsumeRefreshes(ctx context.Context) {
+	slog.Info("Consuming refresh queue", "max_length", w.cfg.RefreshQueue.MaxLength, "poll_interval", w.cfg.RefreshQueue.PollInterval)
+
+	for ctx.Err() == nil {
+		n, err := w.refreshQueued(ctx)
+
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			slog.Error("Failed to process refresh queue", "error", err, "retry_in", refreshRetryDelay)
+			sleep(ctx, refreshRetryDelay)
+		case n == 0:
+			sleep(ctx, w.cfg.RefreshQueue.PollInterval)
+		}
+	}
+
+	slog.Info("Refresh queue consumer stopped")
+}
+
+// refreshQueued handles one batch from the queue and returns how many ids
+// it took. Ids of a batch that fails are dropped; the next miss for those
+// users queues them again. Users are cached under their stored username,
+// like a full sweep does.
+func (w *Worker) refreshQueued(ctx context.Context) (int, error) {
+	ids, err := w.redis.PopRefreshes(ctx, w.cfg.Precache.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("pop refresh queue: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	users, err := w.db.UsersByIDs(ctx, ids)
+	if err != nil {
+		return len(ids), fmt.Errorf("load queued users: %w", err)
+	}
+
+	if err := w.cacheUsers(ctx, users); err != nil {
+		return len(ids), fmt.Errorf("cache queued users: %w", err)
+	}
+
+	slog.Debug("Refreshed queued users", "queued", len(ids), "cached", len(users))
+	return len(ids), nil
+}
@@ -0,0 +1,336 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-auth/pkg/redis"
+)
+
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+
+	historyName = "precache-runs"
+)
+
+var (
+	// ErrRunInProgress is returned by Execute when a run is already active
+	// and the overlap policy does not allow this one to wait.
+	ErrRunInProgress = errors.New("precache run already in progress")
+
+	// ErrRunCancelled is the error recorded for a run stopped with Cancel.
+	ErrRunCancelled = errors.New("precache run cancelled")
+
+	// ErrShuttingDown is returned for runs requested after Shutdown, and
+	// recorded for the run Shutdown interrupted.
+	ErrShuttingDown = errors.New("precache worker shutting down")
+)
+
+// RunRecord is one entry of the run history.
+type RunRecord struct {
+	ID         string    `json:"id"`
+	Trigger    string    `json:"trigger"`
+	Mode       string    `json:"mode,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+	Processed  int       `json:"processed"`
+	Evicted    int       `json:"evicted"`
+	// SkippedOverBudget counts users left uncached by the memory budget.
+	SkippedOverBudget int `json:"skipped_over_budget"`
+	// ResumedFrom is the last id of the interrupted run this one continued,
+	// and ResumedFromRun the id of the run that started the sweep.
+	ResumedFrom    int64  `json:"resumed_from,omitempty"`
+	ResumedFromRun string `json:"resumed_from_run,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Progress describes the run currently executing.
+type Progress struct {
+	RunID             string    `json:"run_id"`
+	Trigger           string    `json:"trigger"`
+	Mode              string    `json:"mode,omitempty"`
+	StartedAt         time.Time `json:"started_at"`
+	LastID            int64     `json:"last_id"`
+	Processed         int       `json:"processed"`
+	Evicted           int       `json:"evicted"`
+	SkippedOverBudget int       `json:"skipped_over_budget"`
+	ResumedFrom       int64     `json:"resumed_from,omitempty"`
+	ResumedFromRun    string    `json:"resumed_from_run,omitempty"`
+
+	// RatePerSecond is filled in by the Progress snapshot.
+	RatePerSecond float64 `json:"rate_per_second"`
+
+	// priorRuns counts the interrupted runs of the sweep this one resumed.
+	priorRuns int
+}
+
+// Execute runs Run under the configured overlap policy and records the
+// outcome in the run history. With the skip policy a run that finds another
+// one active is dropped; with the queue policy it waits for the active run
+// to finish, but at most one run waits at a time so they cannot pile up.
+func (w *Worker) Execute(ctx context.Context, trigger string) (*RunRecord, error) {
+	if !w.acquireRunSlot() {
+		slog.Warn("Skipping precache run, previous run still active", "trigger", trigger, "policy", w.cfg.Precache.OverlapPolicy)
+		return nil, ErrRunInProgress
+	}
+	defer w.running.Unlock()
+
+	if w.closed.Load() {
+		return nil, ErrShuttingDown
+	}
+	return w.execute(ctx, trigger, false)
+}
+
+// Trigger starts a run in the background unless one is already active,
+// regardless of the overlap policy. With restart it ignores the checkpoint
+// of an interrupted run and sweeps from the beginning.
+func (w *Worker) Trigger(trigger string, restart bool) error {
+	if !w.running.TryLock() {
+		return ErrRunInProgress
+	}
+	if w.closed.Load() {
+		w.running.Unlock()
+		return ErrShuttingDown
+	}
+
+	go func() {
+		defer w.running.Unlock()
+
+		record, err := w.execute(context.Background(), trigger, restart)
+		if err != nil {
+			slog.Error("Precache worker run failed", "trigger", trigger, "error", err)
+			return
+		}
+		slog.Info("Precache worker run completed", "trigger", trigger, "run_id", record.ID, "processed", record.Processed, "duration", record.Duration)
+	}()
+	return nil
+}
+
+// Cancel stops the active run, if any, and reports whether there was one.
+// The run keeps its checkpoint, so the next run resumes it.
+func (w *Worker) Cancel() bool {
+	return w.cancelRun(ErrRunCancelled)
+}
+
+// Shutdown refuses new runs, cancels the active one and waits for it to
+// record its outcome and checkpoint.
+func (w *Worker) Shutdown() {
+	w.closed.Store(true)
+	if w.cancelRun(ErrShuttingDown) {
+		slog.Info("Cancelled in-flight precache run for shutdown")
+	}
+
+	w.running.Lock()
+	w.running.Unlock()
+}
+
+func (w *Worker) cancelRun(cause error) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cancel == nil {
+		return false
+	}
+	w.cancel(cause)
+	return true
+}
+
+// Pause stops scheduled runs from starting until Resume is called. Runs
+// started with Trigger are not affected.
+func (w *Worker) Pause() {
+	w.paused.Store(true)
+}
+
+func (w *Worker) Resume() {
+	w.paused.Store(false)
+}
+
+func (w *Worker) Paused() bool {
+	return w.paused.Load()
+}
+
+// execute performs one recorded run. The caller holds the run slot.
+func (w *Worker) execute(ctx context.Context, trigger string, restart bool) (*RunRecord, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	if w.elector != nil {
+		runCtx, cancel, token, err := w.elector.lead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer cancel()
+
+		// Cache writes made under this context are dropped once a later
+		// tenure starts, even if the lease is lost mid-batch.
+		ctx = w.redis.WithFence(runCtx, leaseName, token)
+		w.term = token
+	}
+	w.restart = restart
+
+	startedAt := time.Now()
+	w.setProgress(&Progress{
+		RunID:     fmt.Sprintf("%d", startedAt.UnixNano()),
+		Trigger:   trigger,
+		StartedAt: startedAt,
+	}, cancel)
+	defer w.setProgress(nil, nil)
+
+	runErr := w.Run(ctx)
+	if errors.Is(runErr, redis.ErrFenced) {
+		runErr = ErrLeadershipLost
+	}
+	if cause := context.Cause(ctx); runErr != nil && (errors.Is(cause, ErrLeadershipLost) || errors.Is(cause, ErrRunCancelled) || errors.Is(cause, ErrShuttingDown)) {
+		runErr = cause
+	}
+
+	progress := w.Progress()
+	finishedAt := time.Now()
+	record := &RunRecord{
+		ID:                progress.RunID,
+		Trigger:           trigger,
+		Mode:              progress.Mode,
+		StartedAt:         startedAt,
+		FinishedAt:        finishedAt,
+		Duration:          finishedAt.Sub(startedAt).String(),
+		Processed:         progress.Processed,
+		Evicted:           progress.Evicted,
+		ResumedFrom:       progress.ResumedFrom,
+		ResumedFromRun:    progress.ResumedFromRun,
+		SkippedOverBudget: progress.SkippedOverBudget,
+	}
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+
+	if err := w.recordRun(record); err != nil {
+		slog.Error("Failed to record precache run", "run_id", record.ID, "error", err)
+	}
+
+	return record, runErr
+}
+
+// History returns up to limit past runs, newest first.
+func (w *Worker) History(ctx context.Context, limit int) ([]RunRecord, error) {
+	values, err := w.redis.History(ctx, historyName, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]RunRecord, 0, len(values))
+	for _, value := range values {
+		var record RunRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			slog.Error("Skipping unreadable run record", "error", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Progress returns a snapshot of the active run, or nil when idle.
+func (w *Worker) Progress() *Progress {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress == nil {
+		return nil
+	}
+	snapshot := *w.progress
+	if elapsed := time.Since(snapshot.StartedAt).Seconds(); elapsed > 0 {
+		snapshot.RatePerSecond = float64(snapshot.Processed) / elapsed
+	}
+	return &snapshot
+}
+
+func (w *Worker) acquireRunSlot() bool {
+	if w.running.TryLock() {
+		return true
+	}
+
+	if w.cfg.Precache.OverlapPolicy != OverlapQueue || !w.queued.CompareAndSwap(false, true) {
+		return false
+	}
+	defer w.queued.Store(false)
+
+	w.running.Lock()
+	return true
+}
+
+func (w *Worker) setProgress(progress *Progress, cancel context.CancelCauseFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.progress = progress
+	w.cancel = cancel
+}
+
+func (w *Worker) setMode(mode string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress != nil {
+		w.progress.Mode = mode
+	}
+}
+
+// recordBatch advances the active run's progress after a batch is cached.
+func (w *Worker) recordBatch(lastID int64, count int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress == nil {
+		return
+	}
+	w.progress.LastID = lastID
+	w.progress.Processed += count
+}
+
+// recordEvicted counts users evicted because they no longer exist.
+func (w *Worker) recordEvicted(count int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress != nil {
+		w.progress.Evicted += count
+	}
+}
+
+func (w *Worker) recordSkipped(count int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress != nil {
+		w.progress.SkippedOverBudget += count
+	}
+}
+
+func (w *Worker) skipped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.progress == nil {
+		return 0
+	}
+	return w.progress.SkippedOverBudget
+}
+
+func (w *Worker) recordRun(record *RunRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// The run context may already be cancelled; the record should still land.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return w.redis.PushHistory(ctx, historyName, string(data), w.cfg.Precache.HistorySize)
+}
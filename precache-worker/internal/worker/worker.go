@@ -2,74 +2,352 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"substack-auth/pkg/bloom"
+	"substack-auth/pkg/codec"
 	"substack-auth/pkg/config"
 	"substack-auth/pkg/database"
 	"substack-auth/pkg/models"
 	"substack-auth/pkg/redis"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type Worker struct {
 	db    *database.Database
 	redis *redis.Redis
+	codec codec.Codec
 	cfg   *config.Config
+
+	running  sync.Mutex
+	queued   atomic.Bool
+	paused   atomic.Bool
+	closed   atomic.Bool
+	mu       sync.Mutex
+	progress *Progress
+	cancel   context.CancelCauseFunc
+
+	// elector is nil unless leader election is enabled; term is the fencing
+	// token of the run in progress and restart tells it to ignore the
+	// checkpoint. Both are only touched while holding running.
+	elector *elector
+	term    int64
+	restart bool
+
+	// sweepStartedAt is the database time at which the full sweep in
+	// progress started, taken over from the checkpoint when it resumes an
+	// interrupted one. It is zero for a resumed sweep whose checkpoint
+	// predates the field. Only touched while holding running.
+	sweepStartedAt time.Time
+
+	// budget is the memory budget of the run in progress.
+	budget *memoryBudget
+
+	// resyncRequested is set by Resync until the binlog tail has swept;
+	// resyncWake interrupts the tail's current session.
+	resyncRequested atomic.Bool
+	resyncWake      chan struct{}
 }
 
-func New(db *database.Database, redis *redis.Redis, cfg *config.Config) *Worker {
-	return &Worker{
+func New(db *database.Database, redis *redis.Redis, codec codec.Codec, cfg *config.Config) (*Worker, error) {
+	if err := validate(cfg); err != nil {
+		return nil, err
+	}
+
+	w := &Worker{
 		db:    db,
 		redis: redis,
+		codec: codec,
 		cfg:   cfg,
+
+		resyncWake: make(chan struct{}, 1),
+	}
+
+	if cfg.Features.LeaderElectionEnabled {
+		w.elector = newElector(redis, cfg.Leader.InstanceID, cfg.Leader.LeaseTTL)
 	}
+
+	return w, nil
 }
 
-func (w *Worker) Run(ctx context.Context) error {
-	slog.Info("Starting precache worker", "batch_size", w.cfg.Precache.BatchSize)
+// validate rejects settings that would otherwise silently fall back to a
+// default behaviour.
+func validate(cfg *config.Config) error {
+	switch cfg.Precache.Mode {
+	case ModeFull, ModeIncremental, ModeCDC, ModeHot:
+	default:
+		return fmt.Errorf("unknown PRECACHE_MODE %q, want %s, %s, %s or %s", cfg.Precache.Mode, ModeFull, ModeIncremental, ModeCDC, ModeHot)
+	}
 
-	lastID := int64(0)
-	totalProcessed := 0
+	switch cfg.Precache.OverlapPolicy {
+	case OverlapSkip, OverlapQueue:
+	default:
+		return fmt.Errorf("unknown PRECACHE_OVERLAP_POLICY %q, want %s or %s", cfg.Precache.OverlapPolicy, OverlapSkip, OverlapQueue)
+	}
 
-	for {
-		users, err := w.loadUsersBatch(ctx, lastID, w.cfg.Precache.BatchSize)
-		if err != nil {
+	switch cfg.Precache.MemoryPolicy {
+	case BudgetStop, BudgetExisting:
+	default:
+		return fmt.Errorf("unknown PRECACHE_MEMORY_POLICY %q, want %s or %s", cfg.Precache.MemoryPolicy, BudgetStop, BudgetExisting)
+	}
+
+	return nil
+}
+
+// Campaign competes for the precache lease until ctx is done. It returns
+// immediately when leader election is disabled.
+func (w *Worker) Campaign(ctx context.Context) {
+	if w.elector == nil {
+		return
+	}
+	w.elector.campaign(ctx)
+}
+
+// sweepAll rewrites every user and rebuilds the Bloom filter. A producer
+// streams users from MySQL into batches while PRECACHE_WRITERS writers
+// encode and pipeline them to Redis; the bounded batch channel makes the
+// producer wait when Redis falls behind. Progress is checkpointed after
+// every batch, and a sweep that finds the checkpoint of an interrupted one
+// continues after its last id.
+func (w *Worker) sweepAll(ctx context.Context) error {
+	started := time.Now()
+	writers := max(w.cfg.Precache.Writers, 1)
+
+	cp, err := w.loadCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	afterID := int64(0)
+	if cp != nil {
+		afterID = cp.LastID
+		w.sweepStartedAt = cp.StartedAt
+		w.resume(cp)
+		slog.Warn("Resuming interrupted precache run, bloom filter and eviction wait for a complete sweep",
+			"resumed_from_run", cp.RunID, "last_id", cp.LastID, "processed", cp.Processed, "runs_since_complete_sweep", cp.Runs)
+	}
+
+	// The filter is only published after a complete sweep; a partial one
+	// would make auth-improved reject users we never reached. A resumed
+	// sweep never sees the users before its checkpoint, so it leaves the
+	// filter and eviction to the next complete sweep.
+	var filter *bloom.Filter
+	if w.cfg.Features.BloomFilterEnabled && cp == nil {
+		filter = bloom.NewWithEstimates(uint64(w.cfg.Bloom.ExpectedItems), w.cfg.Bloom.FalsePositiveRate)
+	}
+
+	// Entries the sweep does not write belong to users that may have been
+	// deleted; they are checked once the sweep is complete.
+	var seen seenKeys
+	if w.cfg.Precache.EvictDeleted && cp == nil {
+		seen = make(seenKeys)
+	}
+
+	if filter != nil {
+		if err := w.redis.BeginBloomRebuild(ctx); err != nil {
+			return fmt.Errorf("start bloom filter rebuild: %w", err)
+		}
+	}
+
+	// The group's context is cancelled once Wait returns; later steps use ctx.
+	g, pipeCtx := errgroup.WithContext(ctx)
+	batches := make(chan userBatch, writers)
+	results := make(chan batchResult, writers)
+
+	g.Go(func() error {
+		defer close(batches)
+		return w.produce(pipeCtx, afterID, filter, seen, batches)
+	})
+
+	var writing sync.WaitGroup
+	for range writers {
+		writing.Add(1)
+		g.Go(func() error {
+			defer writing.Done()
+			return w.write(pipeCtx, batches, results)
+		})
+	}
+	go func() {
+		writing.Wait()
+		close(results)
+	}()
+
+	totalProcessed := w.collect(pipeCtx, results)
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if filter != nil {
+		if err := w.checkFence(ctx); err != nil {
 			return err
 		}
 
-		if len(users) == 0 {
-			break
+		if err := w.redis.PublishBloom(ctx, filter); err != nil {
+			slog.Error("Failed to publish bloom filter", "error", err)
+			return err
 		}
 
-		if err := w.cacheUsers(ctx, users); err != nil {
+		if totalProcessed > w.cfg.Bloom.ExpectedItems {
+			slog.Warn("Bloom filter holds more users than expected, false positive rate will rise",
+				"users", totalProcessed, "expected_items", w.cfg.Bloom.ExpectedItems)
+		}
+		slog.Info("Published bloom filter", "users", totalProcessed, "bits", filter.Bits(), "hashes", filter.Hashes())
+	}
+
+	evicted := 0
+	if seen != nil {
+		if evicted, err = w.evictDeleted(ctx, seen); err != nil {
+			slog.Error("Failed to evict deleted users", "error", err)
 			return err
 		}
+	}
+
+	if err := w.ResetCheckpoint(ctx); err != nil {
+		slog.Error("Failed to clear precache checkpoint", "error", err)
+	}
+
+	elapsed := time.Since(started)
+	slog.Info("Precache worker completed", "total_processed", totalProcessed, "evicted", evicted,
+		"skipped_over_budget", w.skipped(), "writers", writers,
+		"duration", elapsed, "users_per_second", int(float64(totalProcessed)/max(elapsed.Seconds(), 0.001)))
+	return nil
+}
+
+// userBatch is a run of users in id order; seq numbers batches in the order
+// they were read.
+type userBatch struct {
+	seq   int
+	users []models.User
+}
+
+type batchResult struct {
+	seq    int
+	lastID int64
+	count  int
+}
+
+// produce streams users after afterID into batches of BATCH_SIZE, adding
+// each to the Bloom filter and the seen set as it goes.
+func (w *Worker) produce(ctx context.Context, afterID int64, filter *bloom.Filter, seen seenKeys, batches chan<- userBatch) error {
+	size := w.cfg.Precache.BatchSize
+	seq := 0
+	users := make([]models.User, 0, size)
 
-		// Update lastID for next iteration (cursor-based pagination)
-		lastID = users[len(users)-1].ID
-		totalProcessed += len(users)
+	send := func() error {
+		select {
+		case batches <- userBatch{seq: seq, users: users}:
+			seq++
+			users = make([]models.User, 0, size)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
-		slog.Info("Processed batch", "last_id", lastID, "count", len(users), "total_processed", totalProcessed)
+	err := w.db.StreamUsers(ctx, afterID, func(user models.User) error {
+		if filter != nil {
+			filter.Add(redis.BloomItem(user.Username))
+		}
+		if seen != nil {
+			seen.add(w.redis.KeyFor(user.Username))
+		}
 
-		if len(users) < w.cfg.Precache.BatchSize {
-			break
+		users = append(users, user)
+		if len(users) < size {
+			return nil
 		}
+		return send()
+	})
+	if err != nil {
+		return fmt.Errorf("stream users: %w", err)
 	}
 
-	slog.Info("Precache worker completed", "total_processed", totalProcessed)
+	if len(users) > 0 {
+		return send()
+	}
 	return nil
 }
 
-func (w *Worker) loadUsersBatch(ctx context.Context, lastID int64, limit int) ([]models.User, error) {
-	var users []models.User
-	query := `SELECT id, username, password_hash, created_at FROM users WHERE id > ? ORDER BY id LIMIT ?`
+// write caches batches until the producer is done or the run is cancelled.
+func (w *Worker) write(ctx context.Context, batches <-chan userBatch, results chan<- batchResult) error {
+	for batch := range batches {
+		if err := w.checkFence(ctx); err != nil {
+			return err
+		}
 
-	err := w.db.DB.SelectContext(ctx, &users, query, lastID, limit)
-	if err != nil {
-		return nil, err
+		users, err := w.admit(ctx, batch.users)
+		if err != nil {
+			return err
+		}
+
+		if err := w.cacheUsers(ctx, users); err != nil {
+			return err
+		}
+
+		result := batchResult{
+			seq:    batch.seq,
+			lastID: batch.users[len(batch.users)-1].ID,
+			count:  len(batch.users),
+		}
+		select {
+		case results <- result:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return ctx.Err()
+}
 
-	return users, nil
+// collect records progress as batches finish. Writers complete out of
+// order, so the reported and checkpointed last id only advances past
+// batches whose predecessors are all written; every user up to it is
+// cached.
+func (w *Worker) collect(ctx context.Context, results <-chan batchResult) int {
+	next := 0
+	done := make(map[int]batchResult)
+	totalProcessed := 0
+
+	for result := range results {
+		done[result.seq] = result
+
+		for {
+			finished, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			next++
+
+			totalProcessed += finished.count
+			w.recordBatch(finished.lastID, finished.count)
+			if ctx.Err() == nil {
+				w.saveCheckpoint(ctx, finished.lastID)
+			}
+
+			slog.Info("Processed batch", "last_id", finished.lastID, "count", finished.count, "total_processed", totalProcessed)
+		}
+	}
+
+	// Batches written after a gap still count as processed.
+	for _, finished := range done {
+		totalProcessed += finished.count
+	}
+	return totalProcessed
+}
+
+// checkFence stops a run whose lease has passed to another replica, so a
+// paused or partitioned former leader does not keep loading batches. The
+// writes themselves carry the term too (see redis.WithFence), which covers
+// a lease lost between this check and the write.
+func (w *Worker) checkFence(ctx context.Context) error {
+	if w.elector == nil {
+		return nil
+	}
+	return w.elector.fence(ctx, w.term)
 }
 
 func (w *Worker) cacheUsers(ctx context.Context, users []models.User) error {
@@ -77,9 +355,9 @@ func (w *Worker) cacheUsers(ctx context.Context, users []models.User) error {
 	batchData := make(map[string]string)
 
 	for _, user := range users {
-		data, err := json.Marshal(user)
+		data, err := w.codec.Encode(&codec.Entry{User: &user, SoftExpiresAt: w.redis.SoftExpiry()})
 		if err != nil {
-			slog.Error("Failed to marshal user", "username", user.Username, "error", err)
+			slog.Error("Failed to encode user", "username", user.Username, "error", err)
 			continue
 		}
 		batchData[user.Username] = string(data)
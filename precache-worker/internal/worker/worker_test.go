@@ -0,0 +1,148 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"substack-auth/pkg/codec"
+	"substack-auth/pkg/config"
+	"substack-auth/pkg/database/databasetest"
+	"substack-auth/pkg/redis"
+	"substack-auth/pkg/redis/redistest"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type testEnv struct {
+	db     *databasetest.DB
+	mr     *miniredis.Miniredis
+	redis  *redis.Redis
+	cfg    *config.Config
+	worker *Worker
+}
+
+// newTestWorker builds a worker over an empty database and Redis with the
+// default configuration, adjusted by configure when it is not nil.
+func newTestWorker(t *testing.T, configure func(*config.Config)) *testEnv {
+	t.Helper()
+
+	mr, r, cfg := redistest.New(t, func(cfg *config.Config) {
+		// miniredis reports no maxmemory, so the budget would never trip.
+		cfg.Precache.MemoryBudget = 0
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	c, err := codec.New(cfg)
+	if err != nil {
+		t.Fatalf("codec.New: %v", err)
+	}
+	db := databasetest.New(t)
+	w, err := New(db.Database, r, c, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return &testEnv{db: db, mr: mr, redis: r, cfg: cfg, worker: w}
+}
+
+// cached returns the entry stored for username, or nil.
+func (env *testEnv) cached(t *testing.T, username string) *codec.Entry {
+	t.Helper()
+
+	data, err := env.redis.Get(context.Background(), username)
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	entry, err := codec.Decode([]byte(data))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return entry
+}
+
+func TestCollectAdvancesPastContiguousBatches(t *testing.T) {
+	tests := []struct {
+		name string
+		// order lists the seq of each finished batch as writers report it;
+		// batch seq covers ids up to (seq+1)*10.
+		order         []int
+		wantLastID    int64
+		wantProcessed int
+	}{
+		{"in order", []int{0, 1, 2}, 30, 30},
+		{"reversed", []int{2, 1, 0}, 30, 30},
+		{"interleaved", []int{1, 0, 3, 2}, 40, 40},
+		{"first batch missing", []int{1, 2}, 0, 20},
+		{"gap after the first batch", []int{0, 2, 3}, 10, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestWorker(t, nil)
+			w := env.worker
+			ctx := context.Background()
+			w.setProgress(&Progress{RunID: "1", StartedAt: time.Now()}, nil)
+
+			results := make(chan batchResult, len(tt.order))
+			for _, seq := range tt.order {
+				results <- batchResult{seq: seq, lastID: int64(seq+1) * 10, count: 10}
+			}
+			close(results)
+
+			if total := w.collect(ctx, results); total != tt.wantProcessed {
+				t.Errorf("collect = %d, want %d", total, tt.wantProcessed)
+			}
+			if got := w.Progress().LastID; got != tt.wantLastID {
+				t.Errorf("progress last id = %d, want %d", got, tt.wantLastID)
+			}
+
+			cp, err := w.loadCheckpoint(ctx)
+			if err != nil {
+				t.Fatalf("loadCheckpoint: %v", err)
+			}
+			switch {
+			case tt.wantLastID == 0 && cp != nil:
+				t.Errorf("checkpoint at %d, want none before the first batch is written", cp.LastID)
+			case tt.wantLastID != 0 && (cp == nil || cp.LastID != tt.wantLastID):
+				t.Errorf("checkpoint = %+v, want last id %d", cp, tt.wantLastID)
+			}
+		})
+	}
+}
+
+func TestSweepAllWithSeveralWriters(t *testing.T) {
+	env := newTestWorker(t, func(cfg *config.Config) {
+		cfg.Precache.BatchSize = 2
+		cfg.Precache.Writers = 4
+	})
+	ctx := context.Background()
+
+	var usernames []string
+	for i := range 25 {
+		user := env.db.AddUser(fmt.Sprintf("user%02d@katakode.com", i), "$2a$10$hash")
+		usernames = append(usernames, user.Username)
+	}
+
+	env.worker.setProgress(&Progress{RunID: "1", StartedAt: time.Now()}, nil)
+	if err := env.worker.sweepAll(ctx); err != nil {
+		t.Fatalf("sweepAll: %v", err)
+	}
+
+	for _, username := range usernames {
+		if env.cached(t, username) == nil {
+			t.Errorf("%s not cached", username)
+		}
+	}
+	if got := env.worker.Progress().Processed; got != len(usernames) {
+		t.Errorf("processed = %d, want %d", got, len(usernames))
+	}
+	if cp, _ := env.worker.loadCheckpoint(ctx); cp != nil {
+		t.Errorf("checkpoint %+v kept after a complete sweep", cp)
+	}
+}